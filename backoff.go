@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffPolicy decides how long to wait before retrying after a
+// failed update or a 503 from the full-hash endpoint. It's pluggable so
+// callers who need to match a different spec (or just want
+// deterministic tests) aren't stuck with the default.
+type BackoffPolicy interface {
+	// NextDelay returns how long to wait before the (attempt+1)'th
+	// retry, where attempt is 0 for the first retry.
+	NextDelay(attempt int) time.Duration
+}
+
+// defaultBackoffPolicy implements the Safe Browsing v4 exponential
+// back-off, jittered by a 0.5+rand() band: MIN(2^N * 15min * (0.5 +
+// rand()), 24h). NextDelay is called concurrently by every per-list
+// Updater worker and by the full-hash back-off path, so randMu guards
+// the shared rand.Rand, which isn't safe for concurrent use on its own.
+type defaultBackoffPolicy struct {
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// NewDefaultBackoffPolicy returns the v4-spec back-off policy used by
+// SafeBrowsing unless a caller sets BackoffPolicy to something else.
+func NewDefaultBackoffPolicy() BackoffPolicy {
+	return &defaultBackoffPolicy{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+const backoffBaseDelay = 15 * time.Minute
+const backoffMaxDelay = 24 * time.Hour
+
+func (p *defaultBackoffPolicy) NextDelay(attempt int) time.Duration {
+	// cap the exponent well before backoffBaseDelay*2^N would overflow
+	// or exceed backoffMaxDelay anyway.
+	if attempt > 16 {
+		attempt = 16
+	}
+	multiplier := float64(uint64(1) << uint(attempt))
+	p.randMu.Lock()
+	jitter := 0.5 + p.rand.Float64()
+	p.randMu.Unlock()
+	delay := time.Duration(multiplier * jitter * float64(backoffBaseDelay))
+	if delay > backoffMaxDelay {
+		return backoffMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// IsListedBatch resolves many URLs in one pass, issuing at most one
+// requestFullHashes call per list no matter how many URLs in the batch
+// hit that list's prefix trie, instead of callers looping over IsListed
+// and paying for a full-hash round trip per URL.
+
+// Result is one URL's outcome from IsListedBatch.
+type Result struct {
+	URL        string
+	List       string
+	Descriptor ListDescriptor
+	Metadata   []byte
+	Err        error
+}
+
+// IsListedBatch checks every URL against every list, the same way
+// IsListed does, but batches the full-hash requests triggered by prefix
+// hits: all prefixes that need resolving for a given list, across the
+// whole batch, are sent to requestFullHashes together.
+func (sb *SafeBrowsing) IsListedBatch(urls []string) ([]Result, error) {
+	results := make([]Result, len(urls))
+	for i, url := range urls {
+		results[i].URL = url
+	}
+
+	if !sb.IsUpToDate() {
+		for i := range results {
+			results[i].Err = ErrOutOfDateHashes
+		}
+		return results, nil
+	}
+
+	// candidateHash pairs a lookup-able candidate hash with the index
+	// of the URL it came from, so a full hash hit can be attributed
+	// back to the right Result.
+	type candidateHash struct {
+		urlIndex int
+		hash     LookupHash
+	}
+
+	// overridden marks URLs that local rules already resolved, so the
+	// list loop below skips them the same way it skips a URL that's
+	// already matched or errored.
+	overridden := make([]bool, len(urls))
+	candidatesByURL := make([][]candidateHash, len(urls))
+	for i, url := range urls {
+		canonical := Canonicalize(url)
+		if sb.ForceBlock != nil && sb.ForceBlock.Matches(canonical) {
+			results[i].List = ForceBlockListName
+			overridden[i] = true
+			continue
+		}
+		if sb.Overrides != nil && sb.Overrides.Matches(canonical) {
+			overridden[i] = true
+			continue
+		}
+		for _, candidate := range GenerateTestCandidates(canonical) {
+			candidatesByURL[i] = append(candidatesByURL[i], candidateHash{
+				urlIndex: i,
+				hash:     getHash(candidate),
+			})
+		}
+	}
+
+	for list, sbl := range sb.Lists {
+		// every prefix across the whole batch that needs a full-hash
+		// lookup for this list, so we only call requestFullHashes once.
+		prefixesToRequest := make(map[LookupHash]bool)
+		prefixHits := make(map[int][]LookupHash)
+
+		for i := range urls {
+			if results[i].List != "" || results[i].Err != nil || overridden[i] {
+				continue
+			}
+			for _, candidate := range candidatesByURL[i] {
+				fullLookupHash := string(candidate.hash)
+				prefix := candidate.hash[:PREFIX_4B_SZ]
+				lookupHash := string(prefix)
+
+				if fhc, ok := sbl.Cache[FullHash(fullLookupHash)]; ok && !fhc.checkValidity() {
+					delete(sbl.Cache, FullHash(fullLookupHash))
+					sbl.FullHashRequested.Delete(lookupHash)
+					sbl.FullHashes.Delete(fullLookupHash)
+				}
+
+				if sbl.FullHashes.Get(fullLookupHash) {
+					results[i].List = list
+					results[i].Descriptor = sbl.Descriptor
+					if fhc, ok := sbl.Cache[FullHash(fullLookupHash)]; ok {
+						results[i].Metadata = fhc.Metadata
+					}
+					break
+				}
+
+				if (sbl.bloom == nil || sbl.bloom.MightContain(lookupHash)) &&
+					sbl.lookupContains(lookupHash) && !sbl.FullHashRequested.Get(lookupHash) {
+					prefixesToRequest[prefix] = true
+					prefixHits[i] = append(prefixHits[i], candidate.hash)
+				}
+			}
+		}
+
+		if len(prefixesToRequest) == 0 {
+			continue
+		}
+		if err := sb.requestFullHashes(list, prefixesToRequest); err != nil {
+			for i := range prefixHits {
+				if results[i].List == "" && results[i].Err == nil {
+					results[i].Err = err
+				}
+			}
+			continue
+		}
+
+		for i, hashes := range prefixHits {
+			if results[i].List != "" {
+				continue
+			}
+			for _, hash := range hashes {
+				if sbl.FullHashes.Get(string(hash)) {
+					results[i].List = list
+					results[i].Descriptor = sbl.Descriptor
+					if fhc, ok := sbl.Cache[FullHash(hash)]; ok {
+						results[i].Metadata = fhc.Metadata
+					}
+					break
+				}
+			}
+		}
+	}
+
+	return results, nil
+}
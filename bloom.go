@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Bloom is a fixed-size Bloom filter sized for BLOOM_FILTER_BITS bits
+// and BLOOM_FILTER_HASHES probes, used by SafeBrowsingList as a cheap
+// first-stage check before walking the (much more expensive) Lookup
+// HatTrie: a negative here means the key is definitely not in Lookup,
+// so the trie lookup can be skipped outright.
+//
+// Rather than computing BLOOM_FILTER_HASHES independent hashes, it
+// uses Kirsch/Mitzenmacher double hashing: h_i(x) = h1(x) + i*h2(x),
+// deriving h1 and h2 from the first and second 8 bytes of a single
+// SHA-256 digest.
+type Bloom struct {
+	Bits []uint64
+}
+
+func newBloom() *Bloom {
+	return &Bloom{
+		Bits: make([]uint64, BLOOM_FILTER_BITS/64+1),
+	}
+}
+
+func bloomDoubleHash(key string) (h1, h2 uint64) {
+	sum := sha256.Sum256([]byte(key))
+	h1 = binary.BigEndian.Uint64(sum[0:8])
+	h2 = binary.BigEndian.Uint64(sum[8:16])
+	return h1, h2
+}
+
+// Add sets every probe bit for key.
+func (b *Bloom) Add(key string) {
+	h1, h2 := bloomDoubleHash(key)
+	for i := uint64(0); i < BLOOM_FILTER_HASHES; i++ {
+		bit := (h1 + i*h2) % BLOOM_FILTER_BITS
+		b.Bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MightContain reports whether key could be in the set: false is a
+// definite "no", true means "maybe, check the trie".
+func (b *Bloom) MightContain(key string) bool {
+	h1, h2 := bloomDoubleHash(key)
+	for i := uint64(0); i < BLOOM_FILTER_HASHES; i++ {
+		bit := (h1 + i*h2) % BLOOM_FILTER_BITS
+		if b.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package safebrowsing
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomAddAndContain(t *testing.T) {
+	b := newBloom()
+	b.Add("example.com/")
+	if !b.MightContain("example.com/") {
+		t.Fatal("added key reported as absent")
+	}
+	if b.MightContain("not-added.example/") {
+		t.Fatal("never-added key reported as present")
+	}
+}
+
+func TestBloomNoFalseNegatives(t *testing.T) {
+	b := newBloom()
+	for i := 0; i < 10000; i++ {
+		b.Add(fmt.Sprintf("host-%d.example/path", i))
+	}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("host-%d.example/path", i)
+		if !b.MightContain(key) {
+			t.Fatalf("false negative for %s", key)
+		}
+	}
+}
+
+// BenchmarkTrieLookupOnly simulates the old behavior: every candidate
+// walks the HatTrie directly.
+func BenchmarkTrieLookupOnly(b *testing.B) {
+	trie := NewTrie()
+	for i := 0; i < 10000; i++ {
+		trie.Set(fmt.Sprintf("host-%d.example/path", i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Get(fmt.Sprintf("absent-%d.example/path", i%1000000))
+	}
+}
+
+// BenchmarkBloomThenTrieLookup shows the cost once the bloom filter is
+// consulted first: absent keys (over 99% of real-world traffic per
+// the request this implements) are rejected by the bloom filter alone
+// and never touch the trie.
+func BenchmarkBloomThenTrieLookup(b *testing.B) {
+	trie := NewTrie()
+	bloom := newBloom()
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("host-%d.example/path", i)
+		trie.Set(key)
+		bloom.Add(key)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("absent-%d.example/path", i%1000000)
+		if bloom.MightContain(key) {
+			trie.Get(key)
+		}
+	}
+}
+
+// BenchmarkBloomSkipRate quantifies what BenchmarkBloomThenTrieLookup
+// only demonstrates indirectly via timing: it counts how many of b.N
+// absent lookups the bloom filter actually lets through to the trie,
+// and reports that as a "trie_walks_pct" metric, so a regression that
+// makes the bloom filter stop prefiltering absent URLs shows up as a
+// number rather than just a timing wobble.
+func BenchmarkBloomSkipRate(b *testing.B) {
+	bloom := newBloom()
+	for i := 0; i < 10000; i++ {
+		bloom.Add(fmt.Sprintf("host-%d.example/path", i))
+	}
+
+	var trieWalks int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("absent-%d.example/path", i%1000000)
+		if bloom.MightContain(key) {
+			trieWalks++
+		}
+	}
+	b.ReportMetric(100*float64(trieWalks)/float64(b.N), "trie_walks_pct")
+}
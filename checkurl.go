@@ -31,7 +31,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	//	"runtime/debug"
 	"strconv"
@@ -44,12 +43,19 @@ import (
 type FullHashCache struct {
 	CreationDate  time.Time
 	CacheLifeTime int
+	// Metadata carries any per-match metadata bytes the server sent
+	// alongside a full hash (the v2.2 gethash "m" marker's per-response
+	// blob, or the v4 API's threatEntryMetadata), so callers can render
+	// list-specific detail without us having to understand the
+	// contents ourselves.
+	Metadata []byte
 }
 
-func newFullHashCache(creationDate time.Time, cacheLifeTime int) (fch *FullHashCache) {
+func newFullHashCache(creationDate time.Time, cacheLifeTime int, metadata []byte) (fch *FullHashCache) {
 	fch = &FullHashCache{
 		CreationDate:  creationDate,
 		CacheLifeTime: cacheLifeTime,
+		Metadata:      metadata,
 	}
 	return fch
 
@@ -79,6 +85,18 @@ var ErrOutOfDateHashes = errors.New("Unable to check listing, list hasn't been u
 func (sb *SafeBrowsing) queryUrl(url string, matchFullHash bool) (list string, fullHashMatch bool, err error) {
 	//	defer debug.FreeOSMemory()
 
+	start := time.Now()
+	defer func() {
+		result := LookupResultNotListed
+		switch {
+		case list != "" && fullHashMatch:
+			result = LookupResultListed
+		case list != "":
+			result = LookupResultPossiblyListed
+		}
+		sb.Metrics.ObserveLookup(list, result, time.Since(start))
+	}()
+
 	if matchFullHash && !sb.IsUpToDate() {
 		// we haven't had a sucessful update in the last 45 mins!  abort!
 		return "", false, ErrOutOfDateHashes
@@ -87,6 +105,17 @@ func (sb *SafeBrowsing) queryUrl(url string, matchFullHash bool) (list string, f
 	// first Canonicalize
 	url = Canonicalize(url)
 
+	// local overrides take priority over whatever upstream says: a
+	// ForceBlock hit is reported as listed without even consulting
+	// sb.Lists, and an Overrides hit suppresses a listing we'd
+	// otherwise report below.
+	if sb.ForceBlock != nil && sb.ForceBlock.Matches(url) {
+		return ForceBlockListName, matchFullHash, nil
+	}
+	if sb.Overrides != nil && sb.Overrides.Matches(url) {
+		return "", false, nil
+	}
+
 	urls := GenerateTestCandidates(url)
 	//      sb.Logger.Debug("Checking %d iterations of url", len(urls))
 	for list, sbl := range sb.Lists {
@@ -115,8 +144,10 @@ func (sb *SafeBrowsing) queryUrl(url string, matchFullHash bool) (list string, f
 				return list, true, nil
 			}
 
-			// now see if there is a match in our prefix trie
-			if sbl.Lookup.Get(lookupHash) {
+			// now see if there is a match in our prefix table; consult
+			// the bloom filter first since a miss there means the
+			// lookup can't possibly hit.
+			if (sbl.bloom == nil || sbl.bloom.MightContain(lookupHash)) && sbl.lookupContains(lookupHash) {
 				if !matchFullHash || OfflineMode {
 					//					sb.Logger.Debug("Partial hash hit")
 					return list, false, nil
@@ -176,6 +207,15 @@ func (sb *SafeBrowsing) requestFullHashes(list string, prefixes map[LookupHash]b
 	if len(prefixes) == 0 {
 		return nil
 	}
+
+	ctx := sb.ctxOrBackground()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if sb.ProtocolVersion == ProtocolV4 {
+		return sb.requestFullHashesV4(list, prefixes)
+	}
 	query := "%d:%d\n%s"
 	buf := bytes.Buffer{}
 	firstPrefixLen := 0
@@ -199,7 +239,8 @@ func (sb *SafeBrowsing) requestFullHashes(list string, prefixes map[LookupHash]b
 		"https://safebrowsing.google.com/safebrowsing/gethash?"+
 			"client=%s&key=%s&appver=%s&pver=%s",
 		sb.Client, sb.Key, sb.AppVersion, sb.ProtocolVersion)
-	response, err := sb.request(url, body, true)
+	start := time.Now()
+	response, err := sb.request(ctx, url, body, true)
 	if err != nil {
 		return err // non-server error with HTTP
 	}
@@ -223,27 +264,31 @@ func (sb *SafeBrowsing) requestFullHashes(list string, prefixes map[LookupHash]b
 	if err != nil {
 		return err
 	}
-	return sb.processFullHashes(string(data))
+	hit, err := sb.processFullHashes(string(data))
+	sb.Metrics.ObserveFullHashRequest(hit, time.Since(start))
+	return err
 }
 
-// Process the retrieved full hashes, saving them to disk
-func (sb *SafeBrowsing) processFullHashes(data string) error {
+// Process the retrieved full hashes, saving them to disk. hit reports
+// whether any full hashes were actually present in the response, for
+// Metrics.ObserveFullHashRequest.
+func (sb *SafeBrowsing) processFullHashes(data string) (hit bool, err error) {
 	//	defer debug.FreeOSMemory()
 
 	pos := strings.IndexByte(data, '\n')
 	if -1 == pos {
-		return nil
+		return false, nil
 	}
 	cacheLifeTime, err := strconv.Atoi(data[0:pos])
 	if err != nil {
-		return err
+		return false, err
 	}
 	data = data[pos+1:]
 
 	for pos, rec_len := 0, 0; pos < len(data); pos += rec_len {
 		nl_pos := strings.IndexByte(data[pos:], '\n')
 		if -1 == nl_pos {
-			return fmt.Errorf("Malformated response: unable to find end of header")
+			return false, fmt.Errorf("Malformated response: unable to find end of header")
 		}
 		header := data[pos : pos+nl_pos]
 		// Increment by the header+newline
@@ -252,49 +297,60 @@ func (sb *SafeBrowsing) processFullHashes(data string) error {
 		headerArray := strings.Split(header, ":")
 		headerRecCount := len(headerArray)
 		if 3 != headerRecCount && 4 != headerRecCount {
-			return fmt.Errorf("Malformated response: %s", header)
+			return false, fmt.Errorf("Malformated response: %s", header)
 		}
 		// How many 32 byte hashes do we have
 		num_resp, err := strconv.Atoi(headerArray[2])
 		if err != nil {
-			return err
+			return false, err
 		} else if 0 >= num_resp {
-			return fmt.Errorf("Malformated response: %s", header)
+			return false, fmt.Errorf("Malformated response: %s", header)
 		} else if (pos + (num_resp * 32)) > len(data) {
-			return fmt.Errorf("Malformated response: %s", header)
+			return false, fmt.Errorf("Malformated response: %s", header)
 		}
 
 		hashes := data[nl_pos+1 : nl_pos+1+(num_resp*32)]
 		// Increment by the number of 32 byte hashes
 		rec_len = rec_len + num_resp*32
 
+		// metadatas holds one entry per hash in this header's block,
+		// nil unless the "m" marker below says metadata follows; it's
+		// handed to readFullHashChunk so each hash's bytes end up on
+		// its own FullHashCache.Metadata instead of being discarded.
+		var metadatas [][]byte
 		if 4 == headerRecCount {
 			// We have metadata, check for a valid marker
 			if "m" != headerArray[3] {
-				return fmt.Errorf("Malformated response: %s", header)
+				return false, fmt.Errorf("Malformated response: %s", header)
 			}
+			metadatas = make([][]byte, num_resp)
 			for resp := 0; resp < num_resp; resp++ {
 				nl_pos = strings.IndexByte(data[pos+rec_len:], '\n')
 				if -1 == nl_pos {
-					return fmt.Errorf("Malformated response: unable to parse metadata length")
+					return false, fmt.Errorf("Malformated response: unable to parse metadata length")
 				}
 				// How many bytes is the metadata record
 				len_meta, err := strconv.Atoi(data[pos+rec_len : pos+rec_len+nl_pos])
 				if err != nil {
-					return err
+					return false, err
 				} else if pos+rec_len+nl_pos+len_meta > len(data) {
-					return fmt.Errorf("Malformated response: %s", header)
+					return false, fmt.Errorf("Malformated response: %s", header)
 				}
+				metaStart := pos + rec_len + nl_pos + 1
+				metadatas[resp] = []byte(data[metaStart : metaStart+len_meta])
 				// Increment by the length field and the meta data
 				rec_len += nl_pos + 1 + len_meta
 			}
 		}
-		err = sb.readFullHashChunk(hashes, headerArray[0], cacheLifeTime)
+		if err = sb.readFullHashChunk(hashes, metadatas, headerArray[0], cacheLifeTime); err != nil {
+			return hit, err
+		}
+		hit = true
 	}
-	return err
+	return hit, nil
 }
 
-func (sb *SafeBrowsing) readFullHashChunk(hashes string, list string, cacheLifeTime int) (err error) {
+func (sb *SafeBrowsing) readFullHashChunk(hashes string, metadatas [][]byte, list string, cacheLifeTime int) (err error) {
 	if hashes == "" || list == "" {
 		return fmt.Errorf("Imcomplete data to readFullHashChunck()")
 	}
@@ -310,8 +366,15 @@ func (sb *SafeBrowsing) readFullHashChunk(hashes string, list string, cacheLifeT
 		} else if sb.Lists[list] == nil {
 			return fmt.Errorf("Google safe browsing list (%s) have not been initialized", list)
 		}
+		var metadata []byte
+		if resp := i / hashlen; resp < len(metadatas) {
+			metadata = metadatas[resp]
+		}
 		sb.Lists[list].FullHashes.Set(hash)
-		sb.Lists[list].Cache[FullHash(hash)] = newFullHashCache(time.Now(), cacheLifeTime)
+		sb.Lists[list].Cache[FullHash(hash)] = newFullHashCache(time.Now(), cacheLifeTime, metadata)
+	}
+	if err := sb.Lists[list].saveFullHashCache(); err != nil {
+		sb.Logger.Warn("Error persisting full hash cache for %s: %s", list, err)
 	}
 	return nil
 }
@@ -319,30 +382,30 @@ func (sb *SafeBrowsing) readFullHashChunk(hashes string, list string, cacheLifeT
 // Continue the attempt to request for full hashes in the background, observing the required backoff behaviour.
 func (sb *SafeBrowsing) doFullHashBackOffRequest(url string, body string) {
 
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	randomFloat := r.Float64()
 	var response *http.Response
-	response.StatusCode = 503
 	var err error
 
-	for x := 0; response.StatusCode == 503; x++ {
-		// first we wait 1 min, than some time between 30-60 mins
-		// doubling until we stop at 480 mins or succeed
-		mins := (30 * (randomFloat + 1) * float64(x)) + 1
-		if mins > 480 {
+	ctx := sb.ctxOrBackground()
+	start := time.Now()
+	const maxBackoffAttempts = 10
+	for attempt := 0; ; attempt++ {
+		if attempt >= maxBackoffAttempts {
 			sb.Logger.Warn(
-				"Back-off for full hash %s exceeded 8 hours, it ain't going to happen, giving up: %s",
+				"Back-off for full hash %s exceeded %d attempts, giving up",
 				body,
-				response,
+				maxBackoffAttempts,
 			)
 			return
 		}
+		delay := sb.BackoffPolicy.NextDelay(attempt)
 		sb.Logger.Warn(
-			"Update failed, in full hash back-off mode (waiting %d mins)",
-			mins,
+			"Update failed, in full hash back-off mode (waiting %s)",
+			delay,
 		)
-		time.Sleep(time.Duration(mins) * time.Minute)
-		response, err = sb.request(url, body, true)
+		sb.Metrics.IncFullHashBackoffs()
+		time.Sleep(delay)
+
+		response, err = sb.request(ctx, url, body, true)
 		if err != nil {
 			sb.Logger.Error(
 				"Unable to request full hashes from response in back-off mode: %s",
@@ -350,15 +413,27 @@ func (sb *SafeBrowsing) doFullHashBackOffRequest(url string, body string) {
 			)
 			continue
 		}
+		if response.StatusCode != 503 {
+			break
+		}
 	}
+	defer response.Body.Close()
+
 	data, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		sb.Logger.Error(
 			"Unable to request full hashes from response in back-off mode: %s",
 			err,
 		)
+		return
+	}
+	var hit bool
+	if sb.ProtocolVersion == ProtocolV4 {
+		hit, err = sb.processFullHashesV4(data)
+	} else {
+		hit, err = sb.processFullHashes(string(data))
 	}
-	err = sb.processFullHashes(string(data))
+	sb.Metrics.ObserveFullHashRequest(hit, time.Since(start))
 	if err != nil {
 		sb.Logger.Error(
 			"Unable process full hashes from response in back-off mode: %s; trying again.",
@@ -40,6 +40,17 @@ type ChunkType string
 const CHUNK_TYPE_ADD = "a"
 const CHUNK_TYPE_SUB = "s"
 
+// ChunkHeader is the "type:chunkNum:hashLen:chunkLen" line that
+// precedes every chunk's body, parsed out on its own so
+// ReadChunkStream can hand it back to the caller without forcing the
+// body to be buffered first.
+type ChunkHeader struct {
+	ChunkNum  ChunkNum
+	ChunkType ChunkType
+	HashLen   int
+	ChunkLen  int
+}
+
 type Chunk struct {
 	ChunkNum  ChunkNum
 	ChunkType ChunkType
@@ -106,81 +117,116 @@ func readSlice(buf *bufio.Reader, numBytes int) (out []byte, err error) {
 	return out, err
 }
 
-// Read a chunk from the provided buffer.
-// The buffer cursor is left at the exact end of the read chunk,
-// allowing for repeated calls to this function.
-// Will return an io.EOF when the end of the stream is encountered.
-func ReadChunk(buf *bufio.Reader) (chunk *Chunk, err error) {
-	header, err := buf.ReadString('\n')
+// ReadChunkStream reads a single chunk's header and body straight off
+// buf, invoking visit once per (host, prefix) entry as it is decoded
+// rather than materialising the whole body in memory first. addChunkNum
+// is only meaningful for SUB chunks; ADD chunks always pass 0, since the
+// wire format has no such field for them.
+//
+// The body is read through an io.LimitedReader capped at the header's
+// declared ChunkLen, so a chunk that runs short errors out instead of
+// blocking, and one that overruns its declared length can't read into
+// whatever follows it in the stream.
+//
+// Will return an io.EOF when the end of the stream is encountered
+// before a header can be read.
+func ReadChunkStream(buf *bufio.Reader, visit func(host HostHash, prefix LookupHash, addChunkNum uint32) error) (header *ChunkHeader, err error) {
+	headerLine, err := buf.ReadString('\n')
 	if err != nil {
 		return nil, err
 	}
-	chunk, err = parseChunkHeader(header[:len(header)-1])
+	parsed, err := parseChunkHeader(headerLine[:len(headerLine)-1])
 	if err != nil {
 		return nil, err
 	}
-	chunk.Hashes = make(map[HostHash][]LookupHash)
-	chunk.AddChunkNums = make(map[HostHash][]uint32)
-	chunkBytes, err := readSlice(buf, chunk.ChunkLen)
-	if err != nil {
-		return nil, fmt.Errorf("Unexpected end of chunk: %s", err)
+	header = &ChunkHeader{
+		ChunkNum:  parsed.ChunkNum,
+		ChunkType: parsed.ChunkType,
+		HashLen:   parsed.HashLen,
+		ChunkLen:  parsed.ChunkLen,
 	}
-	for x := 0; x < chunk.ChunkLen; {
-		if x+4 > len(chunkBytes) {
-			return nil, fmt.Errorf("Unexpected end of chunk")
+	body := &io.LimitedReader{R: buf, N: int64(header.ChunkLen)}
+	var staging [4]byte
+	for body.N > 0 {
+		if _, err := io.ReadFull(body, staging[:4]); err != nil {
+			return nil, fmt.Errorf("Unexpected end of chunk: %s", err)
 		}
-		hostKey := HostHash(chunkBytes[x : x+4])
-		x += 4
-		if _, exists := chunk.Hashes[hostKey]; !exists {
-			chunk.Hashes[hostKey] = make([]LookupHash, 0)
-			if chunk.ChunkType == CHUNK_TYPE_SUB {
-				chunk.AddChunkNums[hostKey] = make([]uint32, 0)
-			}
+		hostKey := HostHash(append([]byte(nil), staging[:4]...))
+		if _, err := io.ReadFull(body, staging[:1]); err != nil {
+			return nil, fmt.Errorf("Unexpected end of chunk: %s", err)
 		}
-		if x > len(chunkBytes) {
-			return nil, fmt.Errorf("Unexpected end of chunk")
-		}
-		count := uint(chunkBytes[x])
-		x++
+		count := uint(staging[0])
 		if count == 0 {
-			chunk.Hashes[hostKey] = append(
-				chunk.Hashes[hostKey], LookupHash(hostKey))
-			if chunk.ChunkType == CHUNK_TYPE_SUB {
-				if x+4 > len(chunkBytes) {
-					return nil, fmt.Errorf("Unexpected end of chunk")
-				}
-				addChunkNum, err := readChunkNumber(chunkBytes, x)
-				x += 4
+			var addChunkNum uint32
+			if header.ChunkType == CHUNK_TYPE_SUB {
+				addChunkNum, err = readChunkNumberFrom(body, &staging)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("Unexpected end of chunk: %s", err)
 				}
-				chunk.AddChunkNums[hostKey] = append(
-					chunk.AddChunkNums[hostKey], addChunkNum)
+			}
+			if err := visit(hostKey, LookupHash(hostKey), addChunkNum); err != nil {
+				return nil, err
 			}
 			continue
 		}
 		for y := uint(0); y < count; y++ {
-			if chunk.ChunkType == CHUNK_TYPE_SUB {
-				if x+4 > len(chunkBytes) {
-					return nil, fmt.Errorf("Unexpected end of chunk")
-				}
-				addChunkNum, err := readChunkNumber(chunkBytes, x)
-				x += 4
+			var addChunkNum uint32
+			if header.ChunkType == CHUNK_TYPE_SUB {
+				addChunkNum, err = readChunkNumberFrom(body, &staging)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("Unexpected end of chunk: %s", err)
 				}
-				chunk.AddChunkNums[hostKey] = append(
-					chunk.AddChunkNums[hostKey], addChunkNum)
 			}
-			if x+chunk.HashLen > len(chunkBytes) {
-				return nil, fmt.Errorf("Unexpected end of chunk")
+			prefix := make([]byte, header.HashLen)
+			if _, err := io.ReadFull(body, prefix); err != nil {
+				return nil, fmt.Errorf("Unexpected end of chunk: %s", err)
+			}
+			if err := visit(hostKey, LookupHash(prefix), addChunkNum); err != nil {
+				return nil, err
 			}
-			prefix := LookupHash(chunkBytes[x : x+chunk.HashLen])
-			x += chunk.HashLen
-			chunk.Hashes[hostKey] = append(chunk.Hashes[hostKey], prefix)
 		}
 	}
-	return chunk, nil
+	return header, nil
+}
+
+func readChunkNumberFrom(body *io.LimitedReader, staging *[4]byte) (uint32, error) {
+	if _, err := io.ReadFull(body, staging[:4]); err != nil {
+		return 0, err
+	}
+	return readChunkNumber(staging[:4], 0)
+}
+
+// Read a chunk from the provided buffer.
+// The buffer cursor is left at the exact end of the read chunk,
+// allowing for repeated calls to this function.
+// Will return an io.EOF when the end of the stream is encountered.
+//
+// This is a thin wrapper around ReadChunkStream, kept for callers that
+// want the whole chunk as a single value rather than streaming entries.
+func ReadChunk(buf *bufio.Reader) (chunk *Chunk, err error) {
+	built := &Chunk{
+		Hashes:       make(map[HostHash][]LookupHash),
+		AddChunkNums: make(map[HostHash][]uint32),
+	}
+	header, err := ReadChunkStream(buf, func(host HostHash, prefix LookupHash, addChunkNum uint32) error {
+		built.Hashes[host] = append(built.Hashes[host], prefix)
+		built.AddChunkNums[host] = append(built.AddChunkNums[host], addChunkNum)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	built.ChunkNum = header.ChunkNum
+	built.ChunkType = header.ChunkType
+	built.HashLen = header.HashLen
+	built.ChunkLen = header.ChunkLen
+	if built.ChunkType != CHUNK_TYPE_SUB {
+		// Only sub chunks carry add-chunk-nums on the wire; keep the map
+		// empty for add chunks exactly as before, rather than leaving it
+		// full of zeroes ReadChunkStream had to supply as placeholders.
+		built.AddChunkNums = make(map[HostHash][]uint32)
+	}
+	return built, nil
 }
 
 func readChunkNumber(chunkBytes []byte, x int) (uint32, error) {
@@ -0,0 +1,142 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// This file persists the full-hash cache (SafeBrowsingList.FullHashes
+// plus the per-hash FullHashCache bookkeeping) to disk, so a restart
+// doesn't force re-requesting every full hash and re-triggering the
+// full-hash 503 back-off in doFullHashBackOffRequest. The on-disk
+// format is a small msgpack-encoded envelope with a version header so
+// future schema changes can be detected and handled explicitly.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// fullHashCacheFormatVersion is bumped whenever fullHashCacheEntry's
+// shape changes in a way that isn't backwards compatible. Bumped to 2
+// when Metadata was added, so a v1 cache on disk is cleanly discarded
+// and rebuilt rather than risking a positional field mismatch.
+const fullHashCacheFormatVersion = 2
+
+// fullHashCacheEntry is the on-disk representation of one cached full
+// hash: a 32 byte key plus the same bookkeeping kept in FullHashCache.
+type fullHashCacheEntry struct {
+	Hash          []byte
+	CreationDate  time.Time
+	CacheLifeTime int
+	Metadata      []byte
+}
+
+// fullHashCacheFile is the envelope written to <list>.fullhashcache.
+type fullHashCacheFile struct {
+	Version int
+	Entries []fullHashCacheEntry
+}
+
+func (ssl *SafeBrowsingList) fullHashCacheFileName() string {
+	return ssl.FileName + ".fullhashcache"
+}
+
+// saveFullHashCache snapshots FullHashes/Cache to disk, writing to a
+// temp file and renaming over the real one so a crash mid-write can
+// never leave a truncated cache behind.
+func (ssl *SafeBrowsingList) saveFullHashCache() error {
+	if ssl.FileName == "" {
+		return nil
+	}
+
+	entries := make([]fullHashCacheEntry, 0, len(ssl.Cache))
+	for hash, fhc := range ssl.Cache {
+		entries = append(entries, fullHashCacheEntry{
+			Hash:          []byte(hash),
+			CreationDate:  fhc.CreationDate,
+			CacheLifeTime: fhc.CacheLifeTime,
+			Metadata:      fhc.Metadata,
+		})
+	}
+
+	data, err := msgpack.Marshal(&fullHashCacheFile{
+		Version: fullHashCacheFormatVersion,
+		Entries: entries,
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding full hash cache: %s", err)
+	}
+
+	tmpFileName := ssl.fullHashCacheFileName() + ".tmp"
+	if err := ioutil.WriteFile(tmpFileName, data, 0644); err != nil {
+		return fmt.Errorf("Error writing full hash cache: %s", err)
+	}
+	if err := os.Rename(tmpFileName, ssl.fullHashCacheFileName()); err != nil {
+		return fmt.Errorf("Error renaming full hash cache: %s", err)
+	}
+	return nil
+}
+
+// loadFullHashCache restores FullHashes/Cache from a prior
+// saveFullHashCache call, skipping (and thus discarding) any entry
+// that's already expired rather than resurrecting it.
+func (ssl *SafeBrowsingList) loadFullHashCache() error {
+	if ssl.FileName == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(ssl.fullHashCacheFileName())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading full hash cache: %s", err)
+	}
+
+	var cacheFile fullHashCacheFile
+	if err := msgpack.Unmarshal(data, &cacheFile); err != nil {
+		return fmt.Errorf("Error decoding full hash cache: %s", err)
+	}
+	if cacheFile.Version != fullHashCacheFormatVersion {
+		ssl.Logger.Warn(
+			"Ignoring full hash cache with unsupported format version %d",
+			cacheFile.Version,
+		)
+		return nil
+	}
+
+	for _, entry := range cacheFile.Entries {
+		fhc := newFullHashCache(entry.CreationDate, entry.CacheLifeTime, entry.Metadata)
+		if !fhc.checkValidity() {
+			continue
+		}
+		hash := FullHash(entry.Hash)
+		ssl.Cache[hash] = fhc
+		ssl.FullHashes.Set(string(entry.Hash))
+	}
+	return nil
+}
@@ -1,123 +1,74 @@
-package safebrowsing
-
-/*
-#cgo LDFLAGS: -lhat-trie
-
-#include <stdio.h>
-#include <stdlib.h>
-#include <string.h>
-#include <hat-trie/hat-trie.h>
-
-hattrie_t* start() {
-	hattrie_t* trie;
-
-	trie = hattrie_create();
-
-	return trie;
-}
+// +build !cgo_hattrie
 
-void set(hattrie_t* h, char* key) {
-	value_t* val;
-	val = hattrie_get(h, key, strlen(key));
-	*val = 1;
-}
-
-int get(hattrie_t* h, char* key) {
-	value_t* val;
-	val = hattrie_tryget(h, key, strlen(key));
-	if (val != 0) {
-		return *val;
-	}
-	return 0;
-}
-
-void delete(hattrie_t* h, char* key) {
-	value_t* val;
-	val = hattrie_tryget(h, key, strlen(key));
-	if (val != 0) {
-		*val = 0;
-	}
-}
-
-char* hattrie_iter_key_string(hattrie_iter_t* i) {
-	size_t len;
-	const char* in_key;
-	char* out_key;
-	in_key = hattrie_iter_key(i, &len);
-	out_key = malloc((len + 1) * sizeof(char));
-	memcpy(out_key, in_key, len);
-	out_key[len] = 0;
-	return out_key;
-}
+package safebrowsing
 
-*/
-import "C"
+// Pure-Go replacement for the cgo hat-trie wrapper in hattrie_cgo.go.
+// This is the default build: it requires no system dependencies, so
+// `go get` works on a stock toolchain. Build with the "cgo_hattrie" tag
+// to link against libhat-trie instead.
+//
+// The workload here is fixed-length binary keys (4 byte hash prefixes
+// and 32 byte full hashes), so a sorted slice with binary search gives
+// us the ordered Iterator the rest of the package relies on without the
+// complexity of a real radix/HAT-trie.
 
-import (
-	"runtime"
-	"unsafe"
-)
+import "sort"
 
 type HatTrie struct {
-	trie *C.hattrie_t
-}
-
-func finalizeHatTrie(c *HatTrie) {
-	C.hattrie_free(c.trie)
+	keys []string
 }
 
 func NewTrie() *HatTrie {
-	trie := C.start()
-	out := &HatTrie{
-		trie: trie,
+	return &HatTrie{
+		keys: make([]string, 0),
 	}
-	runtime.SetFinalizer(out, finalizeHatTrie)
-	return out
 }
 
-func (h *HatTrie) Delete(key string) {
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
-	C.delete(h.trie, ckey)
+func (h *HatTrie) search(key string) (index int, found bool) {
+	index = sort.SearchStrings(h.keys, key)
+	found = index < len(h.keys) && h.keys[index] == key
+	return index, found
 }
 
 func (h *HatTrie) Set(key string) {
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
-	C.set(h.trie, ckey)
+	index, found := h.search(key)
+	if found {
+		return
+	}
+	h.keys = append(h.keys, "")
+	copy(h.keys[index+1:], h.keys[index:])
+	h.keys[index] = key
 }
 
 func (h *HatTrie) Get(key string) bool {
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
-	val := C.get(h.trie, ckey)
-	return val == 1
+	_, found := h.search(key)
+	return found
 }
 
-type HatTrieIterator struct {
-	iterator *C.hattrie_iter_t
+func (h *HatTrie) Delete(key string) {
+	index, found := h.search(key)
+	if !found {
+		return
+	}
+	h.keys = append(h.keys[:index], h.keys[index+1:]...)
 }
 
-func finalizeHatTrieIterator(i *HatTrieIterator) {
-	C.hattrie_iter_free(i.iterator)
+type HatTrieIterator struct {
+	keys []string
+	pos  int
 }
 
 func (h *HatTrie) Iterator() *HatTrieIterator {
-	out := C.hattrie_iter_begin(h.trie, true)
-	hi := &HatTrieIterator{
-		iterator: out,
+	return &HatTrieIterator{
+		keys: h.keys,
 	}
-	runtime.SetFinalizer(hi, finalizeHatTrieIterator)
-	return hi
 }
 
 func (i *HatTrieIterator) Next() string {
-	if C.hattrie_iter_finished(i.iterator) {
+	if i.pos >= len(i.keys) {
 		return ""
 	}
-	ckey := C.hattrie_iter_key_string(i.iterator)
-	defer C.free(unsafe.Pointer(ckey))
-	key := C.GoString(ckey)
-	C.hattrie_iter_next(i.iterator)
+	key := i.keys[i.pos]
+	i.pos++
 	return key
 }
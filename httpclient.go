@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// buildRequest constructs the *http.Request doHTTPRequest and
+// defaultListRequest both issue: a POST when body is non-empty (the
+// "downloads" and "gethash" endpoints both work this way), otherwise a
+// plain GET (the "list" endpoint). Building it with ctx means a
+// cancelled or timed-out ctx aborts the request even while it's
+// in-flight, not just before it's sent.
+func buildRequest(ctx context.Context, url string, body string, post bool) (*http.Request, error) {
+	if body != "" {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		return req, nil
+	}
+	return http.NewRequestWithContext(ctx, "GET", url, nil)
+}
+
+// doHTTPRequest is the default implementation of SafeBrowsing.request.
+// It always goes through ss.HTTPClient, so a caller-supplied Transport
+// - custom *tls.Config, client certificates, a corporate proxy -
+// applies to every request this library makes.
+func (ss *SafeBrowsing) doHTTPRequest(ctx context.Context, url string, body string, post bool) (*http.Response, error) {
+	req, err := buildRequest(ctx, url, body, post)
+	if err != nil {
+		return nil, err
+	}
+	return ss.HTTPClient.Do(req)
+}
+
+// defaultListRequest is the default implementation of
+// SafeBrowsingList.request, used only for a list constructed outside
+// of SafeBrowsing (e.g. in tests): it behaves like doHTTPRequest but
+// goes through http.DefaultClient since a standalone list has no
+// HTTPClient of its own. SafeBrowsing overrides it with ss.request on
+// every list it creates.
+func defaultListRequest(ctx context.Context, url string, body string, post bool) (*http.Response, error) {
+	req, err := buildRequest(ctx, url, body, post)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// ListDescriptor identifies a Safe Browsing list by the v4 triple of
+// threat type, platform type and threat entry type, rather than the
+// hardcoded legacy shavar list name. This is what lets callers add
+// lists like UNWANTED_SOFTWARE or POTENTIALLY_HARMFUL_APPLICATION
+// without us hardcoding a name-to-warning-text map for them.
+type ListDescriptor struct {
+	ThreatType      string
+	PlatformType    string
+	ThreatEntryType string
+}
+
+// Name returns the legacy internal list name this descriptor maps to,
+// which is still what SafeBrowsingList.Name and SafeBrowsing.Lists are
+// keyed by.
+func (d ListDescriptor) Name() string {
+	if name, exists := threatTypeToListName[d.ThreatType]; exists {
+		return name
+	}
+	return d.ThreatType
+}
+
+// Title is a short, human readable summary of why a list's entries are
+// dangerous, suitable for a warning dialog's heading.
+func (d ListDescriptor) Title() string {
+	switch d.ThreatType {
+	case "MALWARE":
+		return "Warning - Visiting this web site may harm your computer."
+	case "SOCIAL_ENGINEERING":
+		return "Warning - Suspected phishing page."
+	case "UNWANTED_SOFTWARE":
+		return "Warning - This site may try to trick you into installing unwanted software."
+	case "POTENTIALLY_HARMFUL_APPLICATION":
+		return "Warning - This application may be malicious."
+	default:
+		return "Warning - This page may be unsafe."
+	}
+}
+
+// Description is a longer explanation to accompany Title.
+func (d ListDescriptor) Description() string {
+	switch d.ThreatType {
+	case "MALWARE":
+		return "This page appears to contain malicious code that could be " +
+			"downloaded to your computer without your consent."
+	case "SOCIAL_ENGINEERING":
+		return "This page may be a forgery or imitation of another website, " +
+			"designed to trick users into sharing personal or financial " +
+			"information. Entering any personal information on this page " +
+			"may result in identity theft or other abuse."
+	case "UNWANTED_SOFTWARE":
+		return "This site has been reported to distribute software that " +
+			"performs unexpected or unwanted actions."
+	case "POTENTIALLY_HARMFUL_APPLICATION":
+		return "This application has been reported to behave maliciously " +
+			"on devices that install it."
+	default:
+		return "This page has been flagged as unsafe by Google Safe Browsing."
+	}
+}
+
+var threatTypeToListName = map[string]string{
+	"MALWARE":                         "goog-malware-shavar",
+	"SOCIAL_ENGINEERING":              "googpub-phish-shavar",
+	"UNWANTED_SOFTWARE":               "goog-unwanted-shavar",
+	"POTENTIALLY_HARMFUL_APPLICATION": "goog-harmful-shavar",
+}
+
+// DefaultThreatLists is the set of lists SafeBrowsing subscribes to
+// when no ThreatLists option is supplied: the two lists this library
+// has always supported, so existing callers see no behavior change.
+var DefaultThreatLists = []ListDescriptor{
+	{ThreatType: "MALWARE", PlatformType: "ANY_PLATFORM", ThreatEntryType: "URL"},
+	{ThreatType: "SOCIAL_ENGINEERING", PlatformType: "ANY_PLATFORM", ThreatEntryType: "URL"},
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import "time"
+
+// LookupResult classifies the outcome of a single queryUrl call, for
+// the "list" dimension ObserveLookup reports alongside duration.
+type LookupResult int
+
+const (
+	// LookupResultNotListed means the URL matched no list at all.
+	LookupResultNotListed LookupResult = iota
+	// LookupResultPossiblyListed means a prefix/bloom hit was found by a
+	// lookup with matchFullHash false (MightBeListed). A prefix hit that
+	// the server doesn't confirm with a full hash match is reported as
+	// LookupResultNotListed.
+	LookupResultPossiblyListed
+	// LookupResultListed means a full hash match confirmed the URL is
+	// listed.
+	LookupResultListed
+)
+
+// String renders a LookupResult as a Prometheus-friendly label value.
+func (r LookupResult) String() string {
+	switch r {
+	case LookupResultListed:
+		return "listed"
+	case LookupResultPossiblyListed:
+		return "possibly_listed"
+	default:
+		return "not_listed"
+	}
+}
+
+// MetricsSink lets an operator wire this library's internal counters up
+// to whatever observability stack they use (Prometheus, statsd, etc.)
+// without requiring them to patch the library itself.
+type MetricsSink interface {
+	// ObserveLookup is called once per queryUrl call (i.e. once per
+	// IsListed/MightBeListed), with the list it matched (empty if
+	// unlisted) and how long the lookup took, including any full-hash
+	// round trip.
+	ObserveLookup(list string, result LookupResult, dur time.Duration)
+	// ObserveUpdate is called once per list every time load finishes
+	// applying chunks to it, whether from the initial on-disk load or
+	// a redirect fetch, with how many hashes were added/removed and
+	// how long that took.
+	ObserveUpdate(list string, added, removed int, dur time.Duration)
+	// ObserveFullHashRequest is called once per full-hash response that
+	// is read and processed: by requestFullHashes on a 200 response, and
+	// by doFullHashBackOffRequest once, after its retries end with a
+	// non-503 response, with dur spanning all of those retries. It
+	// reports whether the server confirmed any of the requested
+	// prefixes. Requests that fail or return another non-200 status
+	// are not observed.
+	ObserveFullHashRequest(hit bool, dur time.Duration)
+	// IncFullHashBackoffs is called each time doFullHashBackOffRequest
+	// starts a back-off wait before retrying a full-hash request.
+	IncFullHashBackoffs()
+	// SetListLastUpdateTimestamp records the last time a given list
+	// was successfully updated.
+	SetListLastUpdateTimestamp(list string, t time.Time)
+}
+
+// noopMetricsSink is the default MetricsSink: it discards everything.
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) ObserveLookup(string, LookupResult, time.Duration) {}
+func (noopMetricsSink) ObserveUpdate(string, int, int, time.Duration)     {}
+func (noopMetricsSink) ObserveFullHashRequest(bool, time.Duration)        {}
+func (noopMetricsSink) IncFullHashBackoffs()                              {}
+func (noopMetricsSink) SetListLastUpdateTimestamp(string, time.Time)      {}
+
+var defaultMetricsSink MetricsSink = noopMetricsSink{}
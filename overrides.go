@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ForceBlockListName is the synthetic list name queryUrl reports for a
+// URL matched by SafeBrowsing.ForceBlock, so callers can tell a local
+// override apart from a genuine upstream Safe Browsing hit.
+const ForceBlockListName = "local-force-block"
+
+// OverrideRuleSet is a reloadable set of host/URL patterns, used for
+// both SafeBrowsing.Overrides (allow-list) and SafeBrowsing.ForceBlock
+// (force-block): exact hostnames, subdomain suffixes ("*.example.com"
+// or ".example.com"), and full URLs, all matched against the same
+// canonicalized host/path form queryUrl already builds for lookups.
+// All methods are safe to call from multiple goroutines.
+type OverrideRuleSet struct {
+	mu       sync.RWMutex
+	hosts    map[string]bool
+	suffixes []string
+	urls     map[string]bool
+}
+
+func newOverrideRuleSet() *OverrideRuleSet {
+	return &OverrideRuleSet{
+		hosts: make(map[string]bool),
+		urls:  make(map[string]bool),
+	}
+}
+
+// add parses one rule line: blank lines and lines starting with "#"
+// are ignored, a pattern containing "/" is matched as a full
+// canonicalized URL, a pattern starting with "*." or "." is matched as
+// a subdomain suffix, and anything else is matched as an exact
+// hostname.
+func (rs *OverrideRuleSet) add(pattern string) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return
+	}
+	switch {
+	case strings.Contains(pattern, "/"):
+		rs.urls[pattern] = true
+	case strings.HasPrefix(pattern, "*."):
+		rs.suffixes = append(rs.suffixes, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		rs.suffixes = append(rs.suffixes, pattern)
+	default:
+		rs.hosts[pattern] = true
+	}
+}
+
+// Matches reports whether canonicalURL - in the host/path form
+// Canonicalize returns - is covered by this rule set.
+func (rs *OverrideRuleSet) Matches(canonicalURL string) bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	if rs.urls[canonicalURL] {
+		return true
+	}
+
+	host := canonicalURL
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	if rs.hosts[host] {
+		return true
+	}
+	for _, suffix := range rs.suffixes {
+		if host == suffix[1:] || strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadOverrideRuleSet reads one pattern per line from path. An empty
+// path is a valid "no rules configured" set.
+func loadOverrideRuleSet(path string) (*OverrideRuleSet, error) {
+	rs := newOverrideRuleSet()
+	if path == "" {
+		return rs, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rs.add(scanner.Text())
+	}
+	return rs, scanner.Err()
+}
+
+// reload re-reads path and atomically swaps rs's rules for the fresh
+// ones, so a Matches call running concurrently on another goroutine
+// never sees a half-replaced rule set. A no-op when path is empty.
+func (rs *OverrideRuleSet) reload(path string) error {
+	if path == "" {
+		return nil
+	}
+	fresh, err := loadOverrideRuleSet(path)
+	if err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	rs.hosts, rs.suffixes, rs.urls = fresh.hosts, fresh.suffixes, fresh.urls
+	rs.mu.Unlock()
+	return nil
+}
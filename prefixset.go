@@ -0,0 +1,212 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// PrefixSet is a compact replacement for the string-keyed HatTrie used
+// by SafeBrowsingList.Lookup/FullHashRequested/FullHashes. Every entry
+// those fields ever hold is one of a small number of fixed widths (a
+// bare 4-byte hash prefix, a bare 32-byte full hash, or the
+// host-hash-prefixed composite keys updateLookupMap builds), so a
+// sorted array per width, binary-searched on lookup, is dramatically
+// lighter than a general string trie: a 4-byte prefix costs 4 bytes
+// instead of a string header plus trie node overhead, and there's
+// nothing to garbage-collect per entry.
+//
+// Add/Delete/Contains/Iterator match HatTrie's shape closely enough
+// that SafeBrowsingList's trie fields can hold a *PrefixSet instead
+// without the rest of the package changing.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+type PrefixSet struct {
+	u32   []uint32   // 4-byte keys
+	full  [][32]byte // 32-byte keys
+	other []string   // any other fixed width this list's keys turn out to be
+}
+
+func NewPrefixSet() *PrefixSet {
+	return &PrefixSet{}
+}
+
+func (p *PrefixSet) Add(key string) {
+	switch len(key) {
+	case 4:
+		v := binary.BigEndian.Uint32([]byte(key))
+		i := sort.Search(len(p.u32), func(i int) bool { return p.u32[i] >= v })
+		if i < len(p.u32) && p.u32[i] == v {
+			return
+		}
+		p.u32 = append(p.u32, 0)
+		copy(p.u32[i+1:], p.u32[i:])
+		p.u32[i] = v
+	case 32:
+		var v [32]byte
+		copy(v[:], key)
+		i := sort.Search(len(p.full), func(i int) bool { return bytes.Compare(p.full[i][:], v[:]) >= 0 })
+		if i < len(p.full) && p.full[i] == v {
+			return
+		}
+		p.full = append(p.full, [32]byte{})
+		copy(p.full[i+1:], p.full[i:])
+		p.full[i] = v
+	default:
+		i := sort.SearchStrings(p.other, key)
+		if i < len(p.other) && p.other[i] == key {
+			return
+		}
+		p.other = append(p.other, "")
+		copy(p.other[i+1:], p.other[i:])
+		p.other[i] = key
+	}
+}
+
+func (p *PrefixSet) Delete(key string) {
+	switch len(key) {
+	case 4:
+		v := binary.BigEndian.Uint32([]byte(key))
+		i := sort.Search(len(p.u32), func(i int) bool { return p.u32[i] >= v })
+		if i < len(p.u32) && p.u32[i] == v {
+			p.u32 = append(p.u32[:i], p.u32[i+1:]...)
+		}
+	case 32:
+		var v [32]byte
+		copy(v[:], key)
+		i := sort.Search(len(p.full), func(i int) bool { return bytes.Compare(p.full[i][:], v[:]) >= 0 })
+		if i < len(p.full) && p.full[i] == v {
+			p.full = append(p.full[:i], p.full[i+1:]...)
+		}
+	default:
+		i := sort.SearchStrings(p.other, key)
+		if i < len(p.other) && p.other[i] == key {
+			p.other = append(p.other[:i], p.other[i+1:]...)
+		}
+	}
+}
+
+func (p *PrefixSet) Contains(key string) bool {
+	switch len(key) {
+	case 4:
+		v := binary.BigEndian.Uint32([]byte(key))
+		i := sort.Search(len(p.u32), func(i int) bool { return p.u32[i] >= v })
+		return i < len(p.u32) && p.u32[i] == v
+	case 32:
+		var v [32]byte
+		copy(v[:], key)
+		i := sort.Search(len(p.full), func(i int) bool { return bytes.Compare(p.full[i][:], v[:]) >= 0 })
+		return i < len(p.full) && p.full[i] == v
+	default:
+		i := sort.SearchStrings(p.other, key)
+		return i < len(p.other) && p.other[i] == key
+	}
+}
+
+// Set and Get are aliases for Add and Contains, kept so PrefixSet is a
+// drop-in replacement for *HatTrie at every existing call site.
+func (p *PrefixSet) Set(key string) {
+	p.Add(key)
+}
+
+func (p *PrefixSet) Get(key string) bool {
+	return p.Contains(key)
+}
+
+// PrefixSetIterator walks a PrefixSet's entries in ascending order,
+// one fixed-width bucket at a time.
+type PrefixSetIterator struct {
+	p   *PrefixSet
+	pos int
+}
+
+func (p *PrefixSet) Iterator() *PrefixSetIterator {
+	return &PrefixSetIterator{p: p}
+}
+
+func (i *PrefixSetIterator) Next() string {
+	p := i.p
+	if i.pos < len(p.u32) {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, p.u32[i.pos])
+		i.pos++
+		return string(buf)
+	}
+	fullPos := i.pos - len(p.u32)
+	if fullPos < len(p.full) {
+		v := p.full[fullPos]
+		i.pos++
+		return string(v[:])
+	}
+	otherPos := fullPos - len(p.full)
+	if otherPos < len(p.other) {
+		i.pos++
+		return p.other[otherPos]
+	}
+	return ""
+}
+
+// buildPrefixSet sorts and dedupes keys once and builds a PrefixSet
+// directly from the result, the "single sorted merge pass" load uses
+// to apply a whole batch of chunks at once instead of paying an
+// Add-per-key insert (an O(n) slice shift each) for every entry.
+func buildPrefixSet(keys []string) *PrefixSet {
+	p := NewPrefixSet()
+	if len(keys) == 0 {
+		return p
+	}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	deduped := sorted[:0]
+	for i, k := range sorted {
+		if i == 0 || k != deduped[len(deduped)-1] {
+			deduped = append(deduped, k)
+		}
+	}
+
+	byWidth := make(map[int][]string)
+	for _, k := range deduped {
+		byWidth[len(k)] = append(byWidth[len(k)], k)
+	}
+	for width, ks := range byWidth {
+		switch width {
+		case 4:
+			p.u32 = make([]uint32, len(ks))
+			for i, k := range ks {
+				p.u32[i] = binary.BigEndian.Uint32([]byte(k))
+			}
+		case 32:
+			p.full = make([][32]byte, len(ks))
+			for i, k := range ks {
+				copy(p.full[i][:], k)
+			}
+		default:
+			p.other = append(p.other, ks...)
+		}
+	}
+	sort.Strings(p.other)
+	return p
+}
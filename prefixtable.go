@@ -0,0 +1,247 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// This file adds an alternative, memory-map-friendly persistence
+// format for a list's hash prefixes, for hosts where keeping every
+// list's PrefixSet resident in the Go heap is too much RSS. Unlike the
+// Storage-backed ".dat" gob chunks (which load() decodes and rewrites
+// in full on every update), a ".prefixtable" file is a small gob
+// header followed by a flat, sorted array of fixed-width
+// (hostHash||prefix) records that an mmapBackend binary-searches
+// directly out of the page cache, never copying the bulk of it into
+// the heap.
+//
+// LookupBackend is implemented by both the existing *PrefixSet (via
+// prefixSetBackend) and mmapBackend, so SafeBrowsingList.lookupContains
+// can use whichever one this list has available.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+)
+
+const hostHashLen = 4
+
+const (
+	prefixTableMagic   = "SBPT"
+	prefixTableVersion = 1
+)
+
+// LookupBackend answers "might this key be in the list" for a single
+// list's hash prefixes. Both *PrefixSet (via prefixSetBackend) and
+// mmapBackend implement it.
+type LookupBackend interface {
+	MightContain(key string) bool
+}
+
+// prefixSetBackend adapts *PrefixSet to LookupBackend.
+type prefixSetBackend struct {
+	set *PrefixSet
+}
+
+func (p prefixSetBackend) MightContain(key string) bool {
+	return p.set.Contains(key)
+}
+
+// prefixTableHeader is the gob-encoded preamble of a ".prefixtable"
+// file. Each record in the flat array that follows is
+// hostHashLen+HashPrefixLen bytes long, so a reader can binary-search
+// that array without decoding anything else.
+type prefixTableHeader struct {
+	Magic          string
+	Version        int
+	HashPrefixLen  int
+	EntryCount     int
+	AddChunkRanges string
+	SubChunkRanges string
+}
+
+// prefixTableFileName is where writePrefixTable persists this list's
+// mmap-able lookup table, alongside its Storage-backed "<name>.dat"
+// chunk data.
+func (ssl *SafeBrowsingList) prefixTableFileName() string {
+	return ssl.FileName + ".prefixtable"
+}
+
+// writePrefixTable rebuilds this list's ".prefixtable" file from the
+// current Lookup trie and atomically renames it into place. Callers
+// must hold updateLock, the same lock load() already holds while it
+// rebuilds Lookup, so the file on disk always matches a consistent
+// snapshot of it.
+func (ssl *SafeBrowsingList) writePrefixTable() error {
+	if ssl.FileName == "" {
+		return nil
+	}
+
+	keys := sortedTrieKeys(ssl.Lookup)
+	recordLen := hostHashLen + ssl.HashPrefixLen
+
+	header := prefixTableHeader{
+		Magic:          prefixTableMagic,
+		Version:        prefixTableVersion,
+		HashPrefixLen:  ssl.HashPrefixLen,
+		EntryCount:     len(keys),
+		AddChunkRanges: ssl.ChunkRanges[CHUNK_TYPE_ADD],
+		SubChunkRanges: ssl.ChunkRanges[CHUNK_TYPE_SUB],
+	}
+
+	var headerBuf bytes.Buffer
+	if err := gob.NewEncoder(&headerBuf).Encode(&header); err != nil {
+		return err
+	}
+
+	tmpName := ssl.prefixTableFileName() + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(f, binary.BigEndian, uint32(headerBuf.Len())); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(headerBuf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	for _, key := range keys {
+		if len(key) != recordLen {
+			// a list with mixed prefix lengths can't be binary
+			// searched as fixed-width records; bail out rather than
+			// write a table lookupContains couldn't trust.
+			f.Close()
+			os.Remove(tmpName)
+			return fmt.Errorf(
+				"prefix table for %s: record length %d != expected %d",
+				ssl.Name, len(key), recordLen)
+		}
+		if _, err := f.Write([]byte(key)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, ssl.prefixTableFileName())
+}
+
+// mmapBackend memory-maps a ".prefixtable" file's sorted record array
+// and answers MightContain with a binary search over it, so looking a
+// key up never has to bring the whole list into the Go heap.
+type mmapBackend struct {
+	data      []byte
+	records   []byte
+	recordLen int
+	count     int
+}
+
+// openMmapBackend loads the header of path and mmaps the record array
+// that follows it.
+func openMmapBackend(path string) (*mmapBackend, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var headerLen uint32
+	if err := binary.Read(f, binary.BigEndian, &headerLen); err != nil {
+		return nil, err
+	}
+	headerBytes := make([]byte, headerLen)
+	if _, err := io.ReadFull(f, headerBytes); err != nil {
+		return nil, err
+	}
+	var header prefixTableHeader
+	if err := gob.NewDecoder(bytes.NewReader(headerBytes)).Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Magic != prefixTableMagic || header.Version != prefixTableVersion {
+		return nil, fmt.Errorf("prefix table %s: bad magic/version", path)
+	}
+
+	recordLen := hostHashLen + header.HashPrefixLen
+	wantSize := int64(4) + int64(headerLen) + int64(recordLen*header.EntryCount)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != wantSize {
+		return nil, fmt.Errorf(
+			"prefix table %s: size %d does not match header (want %d)",
+			path, info.Size(), wantSize)
+	}
+
+	data, err := syscall.Mmap(
+		int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	recordsOffset := 4 + int(headerLen)
+	return &mmapBackend{
+		data:      data,
+		records:   data[recordsOffset:],
+		recordLen: recordLen,
+		count:     header.EntryCount,
+	}, nil
+}
+
+// MightContain binary-searches the mmap'd, sorted record array for
+// key, never copying the array itself into the heap.
+func (m *mmapBackend) MightContain(key string) bool {
+	if m == nil || m.recordLen == 0 {
+		return false
+	}
+	target := []byte(key)
+	i := sort.Search(m.count, func(i int) bool {
+		start := i * m.recordLen
+		return bytes.Compare(m.records[start:start+m.recordLen], target) >= 0
+	})
+	if i >= m.count {
+		return false
+	}
+	start := i * m.recordLen
+	return bytes.Equal(m.records[start:start+m.recordLen], target)
+}
+
+// Close unmaps the backing file. Safe to call on a nil backend.
+func (m *mmapBackend) Close() error {
+	if m == nil || m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
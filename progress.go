@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import "time"
+
+// ProgressReporter receives callbacks while a list's redirect chunks
+// are being downloaded, so a CLI can drive a progress bar or a service
+// can feed counters/histograms into Prometheus. All methods must be
+// safe to call from multiple goroutines, since redirects for a single
+// list are fetched concurrently.
+type ProgressReporter interface {
+	// OnListStart is called once, before a list's redirects begin
+	// downloading.
+	OnListStart(list string, totalRedirects int)
+	// OnRedirectDone is called after each redirect finishes, whether it
+	// succeeded or not; index is 0-based.
+	OnRedirectDone(list string, index int, total int, bytes int64)
+	// OnListComplete is called once a list's redirects have all been
+	// processed (or the fetch was aborted), with the total time spent.
+	OnListComplete(list string, dur time.Duration)
+}
+
+// noopProgressReporter is the default ProgressReporter: it does nothing.
+type noopProgressReporter struct{}
+
+func (noopProgressReporter) OnListStart(list string, totalRedirects int)              {}
+func (noopProgressReporter) OnRedirectDone(list string, index, total int, bytes int64) {}
+func (noopProgressReporter) OnListComplete(list string, dur time.Duration)             {}
+
+var defaultProgressReporter ProgressReporter = noopProgressReporter{}
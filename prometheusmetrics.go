@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics is the ready-made MetricsSink for operators running
+// this as a URL-filtering service: every method registers (or updates)
+// a counter/histogram on the Registerer passed to
+// NewPrometheusMetrics, so hit rates, update lag, and full-hash
+// round-trip latency show up in Grafana without anyone having to
+// implement MetricsSink themselves.
+type PrometheusMetrics struct {
+	lookupsTotal         *prometheus.CounterVec
+	lookupDuration       *prometheus.HistogramVec
+	updatesTotal         *prometheus.CounterVec
+	updateEntriesAdded   *prometheus.CounterVec
+	updateEntriesRemoved *prometheus.CounterVec
+	updateDuration       *prometheus.HistogramVec
+	fullHashRequests     *prometheus.CounterVec
+	fullHashDuration     prometheus.Histogram
+	fullHashBackoffs     prometheus.Counter
+	listLastUpdate       *prometheus.GaugeVec
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics and registers all of
+// its collectors on reg. Pass the result as SafeBrowsing.Metrics; reg
+// is typically prometheus.DefaultRegisterer, or a dedicated
+// prometheus.NewRegistry() when embedding multiple SafeBrowsing
+// instances that must not collide on metric names.
+func NewPrometheusMetrics(reg prometheus.Registerer) *PrometheusMetrics {
+	pm := &PrometheusMetrics{
+		lookupsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "safebrowsing",
+			Name:      "lookups_total",
+			Help:      "Total URL lookups, by matched list and result (not_listed/possibly_listed/listed).",
+		}, []string{"list", "result"}),
+		lookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "safebrowsing",
+			Name:      "lookup_duration_seconds",
+			Help:      "Time taken by IsListed/MightBeListed, including any full-hash round trip.",
+		}, []string{"list", "result"}),
+		updatesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "safebrowsing",
+			Name:      "list_updates_total",
+			Help:      "Total times a list's chunk data was reloaded.",
+		}, []string{"list"}),
+		updateEntriesAdded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "safebrowsing",
+			Name:      "list_entries_added_total",
+			Help:      "Hashes added to a list's add chunks across all updates.",
+		}, []string{"list"}),
+		updateEntriesRemoved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "safebrowsing",
+			Name:      "list_entries_removed_total",
+			Help:      "Hashes removed via a list's sub chunks across all updates.",
+		}, []string{"list"}),
+		updateDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "safebrowsing",
+			Name:      "list_update_duration_seconds",
+			Help:      "Time taken to apply new chunk data to a list.",
+		}, []string{"list"}),
+		fullHashRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "safebrowsing",
+			Name:      "full_hash_requests_total",
+			Help:      "Full-hash round trips, by whether the server confirmed a match.",
+		}, []string{"hit"}),
+		fullHashDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "safebrowsing",
+			Name:      "full_hash_request_duration_seconds",
+			Help:      "Time taken by a full-hash round trip, including back-off retries.",
+		}),
+		fullHashBackoffs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "safebrowsing",
+			Name:      "full_hash_backoffs_total",
+			Help:      "Total back-off waits taken before retrying a full-hash request.",
+		}),
+		listLastUpdate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "safebrowsing",
+			Name:      "list_last_update_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful update for a list.",
+		}, []string{"list"}),
+	}
+	reg.MustRegister(
+		pm.lookupsTotal,
+		pm.lookupDuration,
+		pm.updatesTotal,
+		pm.updateEntriesAdded,
+		pm.updateEntriesRemoved,
+		pm.updateDuration,
+		pm.fullHashRequests,
+		pm.fullHashDuration,
+		pm.fullHashBackoffs,
+		pm.listLastUpdate,
+	)
+	return pm
+}
+
+func (pm *PrometheusMetrics) ObserveLookup(list string, result LookupResult, dur time.Duration) {
+	pm.lookupsTotal.WithLabelValues(list, result.String()).Inc()
+	pm.lookupDuration.WithLabelValues(list, result.String()).Observe(dur.Seconds())
+}
+
+func (pm *PrometheusMetrics) ObserveUpdate(list string, added, removed int, dur time.Duration) {
+	pm.updatesTotal.WithLabelValues(list).Inc()
+	pm.updateEntriesAdded.WithLabelValues(list).Add(float64(added))
+	pm.updateEntriesRemoved.WithLabelValues(list).Add(float64(removed))
+	pm.updateDuration.WithLabelValues(list).Observe(dur.Seconds())
+}
+
+func (pm *PrometheusMetrics) ObserveFullHashRequest(hit bool, dur time.Duration) {
+	pm.fullHashRequests.WithLabelValues(strconv.FormatBool(hit)).Inc()
+	pm.fullHashDuration.Observe(dur.Seconds())
+}
+
+func (pm *PrometheusMetrics) IncFullHashBackoffs() {
+	pm.fullHashBackoffs.Inc()
+}
+
+func (pm *PrometheusMetrics) SetListLastUpdateTimestamp(list string, t time.Time) {
+	pm.listLastUpdate.WithLabelValues(list).Set(float64(t.Unix()))
+}
@@ -27,15 +27,16 @@ package safebrowsing
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"runtime/debug"
 )
@@ -48,16 +49,89 @@ var SupportedLists map[string]bool = map[string]bool{
 type HostHash string
 type LookupHash string
 
+// ProtocolVersion selects which Safe Browsing API generation a
+// SafeBrowsing client speaks to the server with. The legacy "v3"
+// pipe-delimited protocol is the default so existing callers keep their
+// current behavior; "v4" switches requestFullHashes over to the JSON
+// fullHashes:find endpoint and update over to threatListUpdates:fetch.
+// The threatMatches:find endpoint is not used.
+const (
+	ProtocolV3 = "v3"
+	ProtocolV4 = "v4"
+)
+
 type SafeBrowsing struct {
-	Key         string
-	Client      string
-	AppVersion  string
-	UpdateDelay int
-	LastUpdated time.Time
-	Lists       map[string]*SafeBrowsingList
-	DataDir     string
-	request     func(string, string, bool) (*http.Response, error)
+	Key             string
+	Client          string
+	AppVersion      string
+	ProtocolVersion string
+	UpdateDelay     int
+	LastUpdated     time.Time
+	Lists           map[string]*SafeBrowsingList
+	DataDir         string
+	// Storage is where each list's chunk data is persisted. Defaults to
+	// LocalStorage rooted at DataDir; set it to something else (e.g. an
+	// S3-compatible implementation of Storage) to share one Safe
+	// Browsing database between instances instead of each one keeping
+	// its own local copy.
+	Storage         Storage
+	// HTTPClient issues the list/downloads/gethash requests made by
+	// request. Defaults to a plain &http.Client{}; set its Transport to
+	// use a custom *tls.Config (client certs, a private CA pool, a
+	// minimum TLS version) or to route through a corporate proxy via
+	// Proxy: http.ProxyFromEnvironment.
+	HTTPClient      *http.Client
+	request         func(context.Context, string, string, bool) (*http.Response, error)
 	Logger		logger
+	// BackoffPolicy governs how long Updater waits before retrying a
+	// list after an update failure, and how long doFullHashBackOffRequest
+	// waits between retries after a full-hash 503; reloadLoop's retries
+	// after a failed update follow their own fixed schedule and do not
+	// consult it. Defaults to the v4-spec exponential-with-full-jitter
+	// policy.
+	BackoffPolicy BackoffPolicy
+	// Metrics receives counters and histograms for lookups, updates,
+	// and full-hash requests/back-offs, so an operator can graph hit
+	// rates, update lag, and full-hash latency; defaults to a no-op
+	// sink. Set it to NewPrometheusMetrics(reg) to export them to a
+	// prometheus.Registerer instead.
+	Metrics MetricsSink
+	// ThreatLists is the set of lists to subscribe to, described as
+	// v4 (ThreatType, PlatformType, ThreatEntryType) triples rather
+	// than a hardcoded legacy list name. Defaults to DefaultThreatLists.
+	ThreatLists []ListDescriptor
+	// MaxParallelRedirects bounds how many redirect URLs each list
+	// fetches concurrently during loadDataFromRedirectLists; applied to
+	// every list wherever SafeBrowsing creates one. Defaults to
+	// defaultMaxParallelRedirects.
+	MaxParallelRedirects int
+	// Progress receives callbacks as each list's redirect chunks
+	// download, for CLI progress bars or Prometheus counters/
+	// histograms. Defaults to a no-op reporter.
+	Progress ProgressReporter
+	// Overrides is an allow-list: a URL it matches is never reported as
+	// listed by IsListed/MightBeListed, even if it hits LookupMap or
+	// FullHashes, so operators can unblock a false positive without
+	// waiting for Google to correct the upstream list. A URL matched by
+	// both Overrides and ForceBlock is reported listed. Populated from
+	// OverridesFile; empty (matches nothing) by default.
+	Overrides *OverrideRuleSet
+	// ForceBlock is the opposite of Overrides: a URL it matches is
+	// always reported listed, under ForceBlockListName, regardless of
+	// what the upstream lists say. Populated from ForceBlockFile; empty
+	// by default.
+	ForceBlock *OverrideRuleSet
+	// OverridesFile and ForceBlockFile are paths to newline-delimited
+	// rule files (see OverrideRuleSet) backing Overrides and
+	// ForceBlock respectively. Set before the first reloadOverrides
+	// call; re-read on every reloadLoop iteration and on SIGHUP. Either
+	// may be left empty to disable that rule set.
+	OverridesFile  string
+	ForceBlockFile string
+	// ctx/cancel bound every update() this instance runs; reloadLoop
+	// exits as soon as ctx is cancelled. Use Close to cancel it.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 var Logger logger = new(DefaultLogger)
@@ -65,24 +139,51 @@ var Client string = "api"
 var AppVersion string = "1.0"
 var OfflineMode bool = false
 
+// UseV4 switches NewSafeBrowsing over to ProtocolV4 (the JSON
+// threatListUpdates:fetch/fullHashes:find endpoints) instead of the
+// deprecated v2.2 pipe-delimited protocol. Set it before calling
+// NewSafeBrowsing; IsListed/MightBeListed/IsUpToDate behave the same
+// either way.
+var UseV4 bool = false
+
 func NewSafeBrowsing(apiKey string, dataDirectory string) (ss *SafeBrowsing, err error) {
 	ss = &SafeBrowsing{
-		Key:        apiKey,
-		Client:     Client,
-		AppVersion: AppVersion,
-		DataDir:    dataDirectory,
-		Lists:      make(map[string]*SafeBrowsingList),
-		request:    request,
-		Logger:     Logger,
+		Key:                  apiKey,
+		Client:               Client,
+		AppVersion:           AppVersion,
+		ProtocolVersion:      ProtocolV3,
+		DataDir:              dataDirectory,
+		Storage:              NewLocalStorage(dataDirectory),
+		Lists:                make(map[string]*SafeBrowsingList),
+		HTTPClient:           &http.Client{},
+		Logger:               Logger,
+		BackoffPolicy:        NewDefaultBackoffPolicy(),
+		Metrics:              defaultMetricsSink,
+		ThreatLists:          DefaultThreatLists,
+		MaxParallelRedirects: defaultMaxParallelRedirects,
+		Progress:             defaultProgressReporter,
+		Overrides:            newOverrideRuleSet(),
+		ForceBlock:           newOverrideRuleSet(),
 	}
+	if UseV4 {
+		ss.ProtocolVersion = ProtocolV4
+	}
+	ss.request = ss.doHTTPRequest
+	ss.ctx, ss.cancel = context.WithCancel(context.Background())
+	go ss.watchOverrideReloadSignal()
 
 	// if we are in offline mode we want to just load up the lists we
 	// currently have and work with that
 	if OfflineMode {
 		for listName, _ := range SupportedLists {
 			fileName := ss.DataDir + "/" + listName + ".dat"
-			tmpList := newSafeBrowsingList(listName, fileName)
+			tmpList := newSafeBrowsingList(listName, fileName, ss.Storage)
 			tmpList.Logger = ss.Logger
+			tmpList.Progress = ss.Progress
+			tmpList.Metrics = ss.Metrics
+			tmpList.request = ss.request
+			tmpList.MaxParallelRedirects = ss.MaxParallelRedirects
+			tmpList.Descriptor = ss.descriptorForListName(listName)
 			err := tmpList.load(nil)
 			if err != nil {
 				ss.Logger.Warn("Error loading list: %s", listName, err)
@@ -95,7 +196,7 @@ func NewSafeBrowsing(apiKey string, dataDirectory string) (ss *SafeBrowsing, err
 	}
 
 	// normal mode, contact the server for updates, etc.
-	err = ss.update()
+	err = ss.update(ss.ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -103,16 +204,76 @@ func NewSafeBrowsing(apiKey string, dataDirectory string) (ss *SafeBrowsing, err
 	return ss, nil
 }
 
+// Close cancels this instance's context, causing reloadLoop to stop
+// scheduling further updates and any in-flight redirect fetch to abort
+// as soon as it next checks ctx.
+func (ss *SafeBrowsing) Close() {
+	ss.cancel()
+}
+
+// ctxOrBackground returns ss.ctx if NewSafeBrowsing has set one, or
+// context.Background() otherwise, so a SafeBrowsing built by hand
+// (tests, OfflineMode callers that skip NewSafeBrowsing) never passes
+// a nil context into ss.request.
+func (ss *SafeBrowsing) ctxOrBackground() context.Context {
+	if ss.ctx != nil {
+		return ss.ctx
+	}
+	return context.Background()
+}
+
+// reloadOverrides re-reads OverridesFile and ForceBlockFile into
+// Overrides and ForceBlock. Called on every reloadLoop iteration and
+// whenever this process receives SIGHUP, so operators can unblock a
+// false positive without restarting.
+func (ss *SafeBrowsing) reloadOverrides() error {
+	if err := ss.Overrides.reload(ss.OverridesFile); err != nil {
+		return fmt.Errorf("Error reloading overrides file: %s", err.Error())
+	}
+	if err := ss.ForceBlock.reload(ss.ForceBlockFile); err != nil {
+		return fmt.Errorf("Error reloading force-block file: %s", err.Error())
+	}
+	return nil
+}
+
+// watchOverrideReloadSignal reloads Overrides/ForceBlock every time
+// this process receives SIGHUP, until ss is Closed.
+func (ss *SafeBrowsing) watchOverrideReloadSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case <-sigCh:
+			if err := ss.reloadOverrides(); err != nil {
+				ss.Logger.Warn("%s", err)
+			}
+		case <-ss.ctx.Done():
+			return
+		}
+	}
+}
+
 func (ss *SafeBrowsing) reloadLoop() {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	randomFloat := r.Float64()
 	for {
-		// wait the update delay
+		// wait the update delay, or stop if we've been closed
 		duration := time.Duration(ss.UpdateDelay) * time.Second
 		ss.Logger.Info("Next update in %d seconds", ss.UpdateDelay)
-		time.Sleep(duration)
-		err := ss.update()
+		select {
+		case <-time.After(duration):
+		case <-ss.ctx.Done():
+			return
+		}
+		if err := ss.reloadOverrides(); err != nil {
+			ss.Logger.Warn("%s", err)
+		}
+		err := ss.update(ss.ctx)
 		for x := 0; err != nil; x++ {
+			if ss.ctx.Err() != nil {
+				return
+			}
 			// first we wait 1 min, than some time between 30-60 mins
 			// doubling until we stop at 480 mins or succeed
 			mins := (30 * (randomFloat + 1) * float64(x)) + 1
@@ -124,16 +285,32 @@ func (ss *SafeBrowsing) reloadLoop() {
 				mins,
 				err,
 			)
-			time.Sleep(time.Duration(mins) * time.Minute)
-			err = ss.update()
+			select {
+			case <-time.After(time.Duration(mins) * time.Minute):
+			case <-ss.ctx.Done():
+				return
+			}
+			err = ss.update(ss.ctx)
 		}
 		debug.FreeOSMemory()
 	}
 }
 
-func (ss *SafeBrowsing) update() error {
+// UpdateWithContext runs a single synchronous update cycle against
+// ctx, so a caller can bound how long it's willing to wait (e.g.
+// context.WithTimeout) instead of relying on reloadLoop's own
+// schedule. It does not affect reloadLoop's background updates; use
+// Close to stop those.
+func (ss *SafeBrowsing) UpdateWithContext(ctx context.Context) error {
+	return ss.update(ctx)
+}
+
+func (ss *SafeBrowsing) update(ctx context.Context) error {
+	if ss.ProtocolVersion == ProtocolV4 {
+		return ss.updateV4(ctx)
+	}
 	ss.Logger.Info("Requesting list of lists from server...")
-	err := ss.requestSafeBrowsingLists()
+	err := ss.requestSafeBrowsingLists(ctx)
 	if err != nil {
 		return err
 	}
@@ -148,26 +325,32 @@ func (ss *SafeBrowsing) update() error {
 	}
 
 	ss.Logger.Info("Requesting updates...")
-	if err := ss.requestRedirectList(); err != nil {
+	if err := ss.requestRedirectList(ctx); err != nil {
 		return fmt.Errorf("Unable to retrieve updates: %s", err.Error())
 	}
 	for listName, list := range ss.Lists {
-		if err := list.loadDataFromRedirectLists(); err != nil {
+		if err := list.loadDataFromRedirectLists(ctx); err != nil {
 			return fmt.Errorf("Unable to process updates for %s: %s", listName, err.Error())
 		}
 	}
 
 	// update the last updated time
 	ss.LastUpdated = time.Now()
+	for listName := range ss.Lists {
+		ss.Metrics.SetListLastUpdateTimestamp(listName, ss.LastUpdated)
+	}
 	return nil
 }
 
-func (ss *SafeBrowsing) requestSafeBrowsingLists() (err error) {
+func (ss *SafeBrowsing) requestSafeBrowsingLists(ctx context.Context) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	url := fmt.Sprintf(
-		"http://safebrowsing.clients.google.com/safebrowsing/list?"+
+		"https://safebrowsing.clients.google.com/safebrowsing/list?"+
 			"client=%s&apikey=%s&appver=%s&pver=2.2",
 		ss.Client, ss.Key, ss.AppVersion)
-	listresp, err := ss.request(url, "", true)
+	listresp, err := ss.request(ctx, url, "", true)
 	if err != nil {
 		return err
 	}
@@ -187,16 +370,33 @@ func (ss *SafeBrowsing) processSafeBrowsingLists(body io.Reader) (err error) {
 			continue
 		}
 		fileName := ss.DataDir + "/" + listName + ".dat"
-		tmpList := newSafeBrowsingList(listName, fileName)
+		tmpList := newSafeBrowsingList(listName, fileName, ss.Storage)
 		tmpList.Logger = ss.Logger
+		tmpList.Progress = ss.Progress
+		tmpList.Metrics = ss.Metrics
+		tmpList.request = ss.request
+		tmpList.MaxParallelRedirects = ss.MaxParallelRedirects
+		tmpList.Descriptor = ss.descriptorForListName(listName)
 		ss.Lists[listName] = tmpList
 	}
 	return nil
 }
 
-func (ss *SafeBrowsing) requestRedirectList() error {
+// descriptorForListName finds the ListDescriptor in ss.ThreatLists that
+// maps onto the given legacy list name, falling back to a zero-value
+// descriptor if the list isn't one we were configured to track.
+func (ss *SafeBrowsing) descriptorForListName(listName string) ListDescriptor {
+	for _, descriptor := range ss.ThreatLists {
+		if descriptor.Name() == listName {
+			return descriptor
+		}
+	}
+	return ListDescriptor{}
+}
+
+func (ss *SafeBrowsing) requestRedirectList(ctx context.Context) error {
 	url := fmt.Sprintf(
-		"http://safebrowsing.clients.google.com/safebrowsing/downloads?"+
+		"https://safebrowsing.clients.google.com/safebrowsing/downloads?"+
 			"client=%s&apikey=%s&appver=%s&pver=2.2",
 		ss.Client, ss.Key, ss.AppVersion)
 
@@ -213,7 +413,7 @@ func (ss *SafeBrowsing) requestRedirectList() error {
 		}
 		listsStr += "\n"
 	}
-	redirects, err := ss.request(url, listsStr, true)
+	redirects, err := ss.request(ctx, url, listsStr, true)
 	if redirects.StatusCode != 200 {
 		tmp := &bytes.Buffer{}
 		tmp.ReadFrom(redirects.Body)
@@ -222,7 +422,7 @@ func (ss *SafeBrowsing) requestRedirectList() error {
 	if err != nil {
 		return err
 	}
-	if err = ss.processRedirectList(redirects.Body); err != nil {
+	if err = ss.processRedirectList(ctx, redirects.Body); err != nil {
 		return err
 	}
 	return nil
@@ -237,14 +437,14 @@ func (ss *SafeBrowsing) reset() {
 			CHUNK_TYPE_ADD: "",
 			CHUNK_TYPE_SUB: "",
 		}
-		// delete any files we have loaded for this map
-		if ssl.FileName != "" {
-			os.Remove(ssl.FileName)
+		// delete any data we have loaded for this list
+		if err := ss.Storage.Remove(ssl.Name); err != nil {
+			ss.Logger.Warn("Error removing stored data for %s: %s", ssl.Name, err)
 		}
 	}
 }
 
-func (ss *SafeBrowsing) processRedirectList(buf io.Reader) error {
+func (ss *SafeBrowsing) processRedirectList(ctx context.Context, buf io.Reader) error {
 	scanner := bufio.NewScanner(buf)
 	var currentList []string = nil
 	currentDeletes := make(map[ChunkType]map[ChunkNum]bool)
@@ -259,7 +459,7 @@ func (ss *SafeBrowsing) processRedirectList(buf io.Reader) error {
 			// we need to reset full!
 			ss.reset()
 			// the docs say to request again, so we do that...
-			return ss.requestRedirectList()
+			return ss.requestRedirectList(ctx)
 		case "i":
 			if currentList != nil {
 				// save to DataRedirects
@@ -272,7 +472,7 @@ func (ss *SafeBrowsing) processRedirectList(buf io.Reader) error {
 			currentDeletes[CHUNK_TYPE_ADD] = make([]ChunkNum, 0)
 			currentDeletes[CHUNK_TYPE_SUB] = make([]ChunkNum, 0)
 		case "u":
-			currentList = append(currentList, "http://"+bits[1])
+			currentList = append(currentList, "https://"+bits[1])
 		case "n":
 			updateDelayStr := bits[1]
 			updateDelay, err := strconv.Atoi(updateDelayStr)
@@ -305,199 +505,3 @@ func (ss *SafeBrowsing) processRedirectList(buf io.Reader) error {
 	}
 	return nil
 }
-
-func getHash(input string) (hash LookupHash) {
-	hasher := sha256.New()
-	hasher.Write([]byte(input))
-	return LookupHash(hasher.Sum(nil))
-}
-
-func insertionSortHashLength(a []LookupHash) {
-	for i := 1; i < len(a); i++ {
-		value := a[i]
-		j := i - 1
-		for j >= 0 && len(a[j]) < len(value) {
-			a[j+1] = a[j]
-			j = j - 1
-		}
-		a[j+1] = value
-	}
-}
-
-// Check to see if a URL is marked as unsafe by Google.
-// Returns what list the URL is on, or an empty string if the URL is unlisted.
-// Note that this query may perform a blocking HTTP request; if speed is important
-// it may be preferable to use MightBeListed which will return quickly.  If showing
-// a warning to the user however, this call must be used.
-func (ss *SafeBrowsing) IsListed(url string) (list string, err error) {
-	list, _, err = ss.queryUrl(url, true)
-	return list, err
-}
-
-// Check to see if a URL is likely marked as unsafe by Google.
-// Returns what list the URL may be listed on, or an empty string if the URL is not listed.
-// Note that this query does not perform a "request for full hashes" and MUST NOT be
-// used to show a warning to the user.
-func (ss *SafeBrowsing) MightBeListed(url string) (list string, fullHashMatch bool, err error) {
-	return ss.queryUrl(url, false)
-}
-
-// Checks to ensure we have had a successful update in the last 45 mins
-func (ss *SafeBrowsing) IsUpToDate() bool {
-	return !OfflineMode && time.Since(ss.LastUpdated) < (time.Duration(45)*time.Minute)
-}
-
-// Here is where we actually look up the hashes against our map.
-func (ss *SafeBrowsing) queryUrl(url string, matchFullHash bool) (list string, fullHashMatch bool, err error) {
-
-	if matchFullHash && !ss.IsUpToDate() {
-		// we haven't had a sucessful update in the last 45 mins!  abort!
-		return "", false, fmt.Errorf(
-			"Unable to check listing, list hasn't been updated for 45 mins")
-	}
-
-	// first Canonicalize
-	url, err = Canonicalize(url)
-	if err != nil {
-		return "", false, nil
-	}
-
-	// now see if there is a host hit
-	hostKey := ExtractHostKey(url)
-	hostKeyHash := HostHash(getHash(hostKey)[:4])
-	ss.Logger.Debug("Host hash: %s", hex.EncodeToString([]byte(hostKeyHash)))
-	for list, ssl := range ss.Lists {
-		hashes, exists := ssl.LookupMap[hostKeyHash]
-		if !exists {
-			ss.Logger.Debug("Host hash not found: %s", hex.EncodeToString([]byte(hostKeyHash)))
-			return "", false, nil
-		}
-		ss.Logger.Debug("Host hash found: " + hex.EncodeToString([]byte(hostKeyHash)))
-
-		urls, err := GenerateTestCandidates(url)
-		if err != nil {
-			return "", false, nil
-		}
-		ss.Logger.Debug("Checking %d iterations of url", len(urls))
-		for _, url := range urls {
-			// hash it up
-			ss.Logger.Debug("Hashing %s", url)
-			urlHash := getHash(url)
-			// build a list of hashes from long to short
-			prefixes := make([]LookupHash, 0, len(ssl.HashSizesBytes))
-			prefixes = append(prefixes, urlHash)
-			for size, _ := range ssl.HashSizesBytes {
-				prefix := urlHash[0:size]
-				ss.Logger.Debug("Generated Hash %s", hex.EncodeToString([]byte(prefix)))
-				prefixes = append(prefixes, prefix)
-			}
-			insertionSortHashLength(prefixes)
-			fullHashRequestList := make([]LookupHash, 0)
-			// now query them!
-			for _, hash := range prefixes {
-				//log.Debug("testing hash: %s", hex.EncodeToString([]byte(hash)))
-				if _, exists := hashes[hash]; exists {
-					// we got a hit! if it's already a full hash there's our answer
-					if len(hash) == 32 {
-						ss.Logger.Debug("Full length hash hit")
-						return list, true, nil
-					}
-					if !matchFullHash {
-						ss.Logger.Debug("Partial hash hit")
-						return list, false, nil
-					}
-					// have we have already asked for full hashes for this prefix?
-					if _, exists := ssl.FullHashRequested[hostKeyHash][hash]; exists {
-						ss.Logger.Debug("Full length hash miss")
-						return "", false, nil
-					}
-					// we matched a prefix and need to request a full hash
-					fullHashRequestList = append(fullHashRequestList, hash)
-				}
-			}
-			if len(fullHashRequestList) > 0 && !OfflineMode {
-				// request any required full hashes
-				err := ss.requestFullHashes(list, hostKeyHash, fullHashRequestList)
-				if err != nil {
-					return "", false, nil
-				}
-				// re-check for full hash hits.
-				for _, hash := range prefixes {
-					ss.Logger.Debug("Need to request full length hashes for %s",
-						hex.EncodeToString([]byte(hash)))
-					if len(hash) == 32 {
-						if _, exists := ssl.LookupMap[hostKeyHash][hash]; exists {
-							return list, true, nil
-						}
-					}
-				}
-			}
-		}
-	}
-
-	return "", false, nil
-}
-
-func (ss *SafeBrowsing) requestFullHashes(list string, host HostHash, prefixes []LookupHash) error {
-	if len(prefixes) == 0 {
-		return nil
-	}
-	query := "%d:%d\n%s"
-	buf := bytes.Buffer{}
-	firstPrefixLen := len(prefixes[0])
-	for _, prefix := range prefixes {
-		_, err := buf.Write([]byte(prefix))
-		if err != nil {
-			return err
-		}
-		if firstPrefixLen != len(prefixes[0]) {
-			return fmt.Errorf("Attempted to used variable length hashes in lookup!")
-		}
-	}
-	body := fmt.Sprintf(query,
-		firstPrefixLen,
-		len(buf.String()),
-		buf.String())
-	url := fmt.Sprintf(
-		"http://safebrowsing.clients.google.com/safebrowsing/gethash?"+
-			"client=%s&apikey=%s&appver=%s&pver=2.2",
-		ss.Client, ss.Key, ss.AppVersion)
-	response, err := ss.request(url, body, true)
-	if err != nil {
-		return err
-	}
-	if response.StatusCode >= 400 {
-		return fmt.Errorf("Unable to lookup hash, server returned %d",
-			response.StatusCode)
-	}
-	// mark these prefxes as having been requested
-	for _, prefix := range prefixes {
-		if _, exists := ss.Lists[list].FullHashRequested[host]; !exists {
-			ss.Lists[list].FullHashRequested[host] = make(map[LookupHash]bool)
-		}
-		ss.Lists[list].FullHashRequested[host][prefix] = true
-	}
-	return ss.processFullHashes(list, response.Body, host)
-}
-
-func (ss *SafeBrowsing) processFullHashes(list string, f io.Reader, host HostHash) error {
-	responseBuf := bufio.NewReader(f)
-	chunks := make([]*Chunk, 0)
-	var err error = nil
-	var chunk *Chunk = nil
-	for err == nil {
-		chunk, err = ReadFullHashChunk(responseBuf, host)
-		if err == nil {
-			chunks = append(chunks, chunk)
-		}
-	}
-	if err != io.EOF {
-		return err
-	}
-	err = ss.Lists[list].load(chunks)
-	if err != nil {
-		return err
-	}
-	debug.FreeOSMemory()
-	return nil
-}
@@ -27,6 +27,7 @@ package safebrowsing
 
 import (
 	//"fmt"
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -57,8 +58,8 @@ func (mrc *MockReadCloser) Close() (err error) {
 	return nil
 }
 
-func NewMockRequest(data string) func(string, string, bool) (*http.Response, error) {
-	request := func(string, string, bool) (*http.Response, error) {
+func NewMockRequest(data string) func(context.Context, string, string, bool) (*http.Response, error) {
+	request := func(context.Context, string, string, bool) (*http.Response, error) {
 		response := &http.Response{
 			StatusCode: 200,
 			Body:       NewMockReadCloser(data),
@@ -75,7 +76,7 @@ func TestSafeBrowsingLists(t *testing.T) {
 		Lists:   make(map[string]*SafeBrowsingList),
 		Logger:  new(DefaultLogger),
 	}
-	err := ss.requestSafeBrowsingLists()
+	err := ss.requestSafeBrowsingLists(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,12 +99,12 @@ sd:2-6`
 	ss := &SafeBrowsing{
 		request: NewMockRequest(data),
 		Lists: map[string]*SafeBrowsingList{
-			"googpub-phish-shavar": newSafeBrowsingList("googpub-phish-shavar", ""),
-			"acme-white-shavar":    newSafeBrowsingList("acme-white-shavar", ""),
+			"googpub-phish-shavar": newSafeBrowsingList("googpub-phish-shavar", "", NewLocalStorage("")),
+			"acme-white-shavar":    newSafeBrowsingList("acme-white-shavar", "", NewLocalStorage("")),
 		},
 		Logger: new(DefaultLogger),
 	}
-	err, _ := ss.requestRedirectList()
+	err := ss.requestRedirectList(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -153,9 +154,9 @@ func TestUrlListed(t *testing.T) {
 			"googpub-phish-shavar": &SafeBrowsingList{
 				Name:              "googpub-phish-shavar",
 				FileName:          tmpDirName + "/googpub-phish-shavar.dat",
-				Lookup:            NewTrie(),
-				FullHashRequested: NewTrie(),
-				FullHashes:        NewTrie(),
+				Lookup:            NewPrefixSet(),
+				FullHashRequested: NewPrefixSet(),
+				FullHashes:        NewPrefixSet(),
 				Cache:             make(map[FullHash]*FullHashCache),
 				DeleteChunks: map[ChunkData_ChunkType]map[ChunkNum]bool{
 					CHUNK_TYPE_ADD: make(map[ChunkNum]bool),
@@ -26,12 +26,15 @@ package safebrowsing
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
 // This calculated assuming a size of 500,000 entries
@@ -40,9 +43,42 @@ import (
 const BLOOM_FILTER_BITS = 50000000
 const BLOOM_FILTER_HASHES = 66
 
+// PREFIX_4B_SZ is the length, in bytes, of the hash prefixes used for the
+// first-pass lookup against the local list data.
+const PREFIX_4B_SZ = 4
+
+// UseMmapPrefixTable switches each list's lookupContains over to a
+// memory-mapped, binary-searched ".prefixtable" file instead of the
+// in-heap Lookup PrefixSet, so a process serving many lists doesn't pay
+// RSS proportional to the sum of their prefix counts. Set it before
+// the first call to NewSafeBrowsing; Lookup itself is still rebuilt by
+// every load (the bloom rebuild and writePrefixTable read from it),
+// it's simply no longer consulted for reads once a prefixTable is
+// available.
+var UseMmapPrefixTable bool = false
+
+// FullHash is a 32 byte SHA256 hash, keyed in SafeBrowsingList.Cache so
+// full-hash responses can be reused until they expire.
+type FullHash string
+
 type SafeBrowsingList struct {
 	Name          string
 	FileName      string
+	// Storage is where this list's chunk data is persisted; load reads
+	// and rewrites through it instead of talking to the filesystem
+	// directly, so callers can supply a non-local (e.g. S3-compatible)
+	// Storage to SafeBrowsing and have every list pick it up.
+	Storage       Storage
+	// Descriptor is the v4 (ThreatType, PlatformType, ThreatEntryType)
+	// this list corresponds to, set from SafeBrowsing.ThreatLists when
+	// the list is created, so callers can render list-specific warning
+	// text without a hardcoded name-to-warning map.
+	Descriptor    ListDescriptor
+	// State is the opaque, server-issued token the v4 Update API uses
+	// to let us fetch an incremental diff next time instead of a full
+	// list; empty until the first successful v4 update. Unused by the
+	// v3 path.
+	State         string
 	DataRedirects []string
 	DeleteChunks  map[ChunkType]map[ChunkNum]bool
 
@@ -52,47 +88,104 @@ type SafeBrowsingList struct {
 	// We have the lookup map keyed by host hash, this may mean we have
 	// to do duplicated full has requests for the same hash prefix on
 	// different hosts, but that should be a pretty rare occurance.
-	Lookup            *HatTrie
-	FullHashRequested *HatTrie
-	FullHashes        *HatTrie
-	EntryCount        int
-	Logger            logger
-	updateLock        *sync.RWMutex
+	Lookup            *PrefixSet
+	FullHashRequested *PrefixSet
+	FullHashes        *PrefixSet
+	// bloom is a first-stage prefilter for Lookup: a MightContain miss
+	// means the key is definitely not in Lookup, so queryUrl can skip
+	// the trie lookup entirely. Kept in sync with Lookup by load, and
+	// persisted alongside it so a restart doesn't have to rebuild it.
+	bloom *Bloom
+	// bloomFresh is true while load is populating a brand new bloom
+	// (nothing usable was found on disk), telling updateLookupMap to
+	// add every key it sees; false means the loaded bloom is being
+	// reused as-is and updateLookupMap should leave it alone.
+	bloomFresh bool
+	// prefixTable is an mmap'd, binary-searchable stand-in for Lookup,
+	// rebuilt by writePrefixTable at the end of every load when
+	// UseMmapPrefixTable is set. lookupContains prefers it over Lookup
+	// whenever it's present, so constrained hosts don't have to keep
+	// every prefix resident in the Go heap to serve lookups.
+	prefixTable *mmapBackend
+	// Cache tracks how long each full hash we've been sent remains
+	// valid for, per the "minimum wait duration" the server returns
+	// alongside it, so we don't have to re-request it on every lookup.
+	Cache      map[FullHash]*FullHashCache
+	EntryCount int
+	Logger     logger
+	// Progress receives callbacks as this list's redirect chunks
+	// download; defaults to a no-op reporter. Set from
+	// SafeBrowsing.Progress whenever the list is created.
+	Progress ProgressReporter
+	// Metrics receives ObserveUpdate calls as load applies new chunk
+	// data to this list; defaults to a no-op sink. Set from
+	// SafeBrowsing.Metrics whenever the list is created.
+	Metrics MetricsSink
+	// request issues this list's redirect-chunk downloads. Defaults to
+	// a standalone http.DefaultClient-based implementation; SafeBrowsing
+	// overrides it with its own HTTPClient-backed one wherever it
+	// creates a list, so proxy and TLS settings apply here too.
+	request    func(context.Context, string, string, bool) (*http.Response, error)
+	updateLock *sync.RWMutex
+	// MaxParallelRedirects bounds how many of this list's redirect URLs
+	// loadDataFromRedirectLists fetches concurrently. Defaults to 4,
+	// Google's documented guidance; set from SafeBrowsing.
+	// MaxParallelRedirects wherever a list is created, so callers with
+	// a single SafeBrowsing config get it consistently across lists.
+	MaxParallelRedirects int
 }
 
-func newSafeBrowsingList(name string, filename string) (ssl *SafeBrowsingList) {
+func newSafeBrowsingList(name string, filename string, storage Storage) (ssl *SafeBrowsingList) {
 	ssl = &SafeBrowsingList{
-		Name:              name,
-		FileName:          filename,
-		DataRedirects:     make([]string, 0),
-		Lookup:            NewTrie(),
-		FullHashRequested: NewTrie(),
-		FullHashes:        NewTrie(),
-		DeleteChunks:      make(map[ChunkType]map[ChunkNum]bool),
-		Logger:            &DefaultLogger{},
-		updateLock:        new(sync.RWMutex),
+		Name:                 name,
+		FileName:             filename,
+		Storage:              storage,
+		DataRedirects:        make([]string, 0),
+		Lookup:               NewPrefixSet(),
+		FullHashRequested:    NewPrefixSet(),
+		FullHashes:           NewPrefixSet(),
+		Cache:                make(map[FullHash]*FullHashCache),
+		DeleteChunks:         make(map[ChunkType]map[ChunkNum]bool),
+		Logger:               &DefaultLogger{},
+		Progress:             defaultProgressReporter,
+		Metrics:              defaultMetricsSink,
+		request:              defaultListRequest,
+		updateLock:           new(sync.RWMutex),
+		MaxParallelRedirects: defaultMaxParallelRedirects,
 	}
 	ssl.DeleteChunks[CHUNK_TYPE_ADD] = make(map[ChunkNum]bool)
 	ssl.DeleteChunks[CHUNK_TYPE_SUB] = make(map[ChunkNum]bool)
+	if err := ssl.loadFullHashCache(); err != nil {
+		ssl.Logger.Warn("Error loading full hash cache for %s: %s", name, err)
+	}
 	return ssl
 }
 
 func (ssl *SafeBrowsingList) load(newChunks []*Chunk) (err error) {
 	ssl.Logger.Info("Reloading %s", ssl.Name)
+	start := time.Now()
 	ssl.updateLock.Lock()
 
+	// prevEntryCount is the trie size the bloom filter was last built
+	// against; if a persisted bloom still matches it we can reuse its
+	// bits as-is instead of paying BLOOM_FILTER_HASHES hashes per key
+	// below.
+	prevEntryCount := ssl.EntryCount
+	ssl.bloom, ssl.bloomFresh = ssl.loadOrInitBloom(prevEntryCount)
+
 	//  get the input stream
-	f, err := os.Open(ssl.FileName)
+	f, err := ssl.Storage.Open(ssl.Name)
 	if err != nil {
 		ssl.Logger.Warn("Error opening data file for reading, assuming empty: %s", err)
+		f = nil
 	}
 	var dec *gob.Decoder = nil
 	if f != nil {
 		dec = gob.NewDecoder(f)
 	}
 
-	// open the file again for output
-	fOut, err := os.Create(ssl.FileName + ".tmp")
+	// open the output for the new, merged data
+	fOut, err := ssl.Storage.Create(ssl.Name)
 	if err != nil {
 		ssl.updateLock.Unlock()
 		return fmt.Errorf("Error opening file: %s", err)
@@ -109,6 +202,12 @@ func (ssl *SafeBrowsingList) load(newChunks []*Chunk) (err error) {
 
 	deletedChunkCount := 0
 
+	// staging accumulates every chunk's adds/deletes so Lookup and
+	// FullHashes are rebuilt once, at the end, via buildPrefixSet
+	// instead of an incremental insert per entry as each chunk is
+	// replayed.
+	staging := newLookupStaging()
+
 	// load 'em up boys
 	if dec != nil {
 		for {
@@ -138,7 +237,7 @@ func (ssl *SafeBrowsingList) load(newChunks []*Chunk) (err error) {
 				subEntryCount += len(chunk.Hashes)
 			}
 			// apply this chunk.
-			ssl.updateLookupMap(chunk)
+			ssl.updateLookupMap(chunk, staging)
 		}
 		if err != io.EOF {
 			ssl.updateLock.Unlock()
@@ -168,22 +267,27 @@ func (ssl *SafeBrowsingList) load(newChunks []*Chunk) (err error) {
 				subChunkIndexes[chunk.ChunkNum] = true
 				subEntryCount += len(chunk.Hashes)
 			}
-			ssl.updateLookupMap(chunk)
+			ssl.updateLookupMap(chunk, staging)
 		}
 	}
 
-	// now close off our files, discard the old and keep the new
+	ssl.Lookup = buildPrefixSet(stagedKeys(staging.lookup))
+	ssl.FullHashes = buildPrefixSet(stagedKeys(staging.fullHashes))
+	// full hashes the server confirmed (or that loadFullHashCache
+	// restored) live in Cache rather than in any chunk, so carry the
+	// still-valid ones over into the rebuilt FullHashes.
+	for hash, fhc := range ssl.Cache {
+		if fhc.checkValidity() {
+			ssl.FullHashes.Set(string(hash))
+		}
+	}
+
+	// now close off our files; fOut.Close() is what actually makes the
+	// freshly written data live, swapping out whatever f read from.
 	if f != nil {
 		f.Close()
-		fOut.Close()
-		err = os.Remove(ssl.FileName)
-		if err != nil {
-			ssl.updateLock.Unlock()
-			return err
-		}
 	}
-	err = os.Rename(ssl.FileName+".tmp", ssl.FileName)
-	if err != nil {
+	if err = fOut.Close(); err != nil {
 		ssl.updateLock.Unlock()
 		return err
 	}
@@ -202,44 +306,260 @@ func (ssl *SafeBrowsingList) load(newChunks []*Chunk) (err error) {
 		deletedChunkCount,
 		len(newChunks),
 	)
+	ssl.Metrics.ObserveUpdate(ssl.Name, newEntryCount, subEntryCount, time.Since(start))
+
+	entryCount := 0
+	iter := ssl.Lookup.Iterator()
+	for key := iter.Next(); key != ""; key = iter.Next() {
+		entryCount++
+	}
+	if !ssl.bloomFresh && entryCount != prevEntryCount {
+		// the sidecar's EntryCount no longer matches the trie we just
+		// rebuilt (a reset, or chunks applied since it was last saved)
+		// so its bits can't be trusted - rebuild from scratch instead.
+		ssl.Logger.Warn("Bloom filter for %s is stale (expected %d entries, found %d), rebuilding",
+			ssl.Name, prevEntryCount, entryCount)
+		ssl.bloom = newBloom()
+		iter = ssl.Lookup.Iterator()
+		for key := iter.Next(); key != ""; key = iter.Next() {
+			ssl.bloom.Add(key)
+		}
+	}
+	ssl.EntryCount = entryCount
+	if err := ssl.saveBloomSnapshot(); err != nil {
+		ssl.Logger.Warn("Error saving bloom filter for %s: %s", ssl.Name, err)
+	}
+
+	if UseMmapPrefixTable {
+		if ssl.prefixTable != nil {
+			ssl.prefixTable.Close()
+			ssl.prefixTable = nil
+		}
+		if err := ssl.writePrefixTable(); err != nil {
+			ssl.Logger.Warn("Error writing prefix table for %s: %s", ssl.Name, err)
+		} else if backend, err := openMmapBackend(ssl.prefixTableFileName()); err != nil {
+			ssl.Logger.Warn("Error mmapping prefix table for %s: %s", ssl.Name, err)
+		} else {
+			ssl.prefixTable = backend
+		}
+	}
+
 	ssl.updateLock.Unlock()
 	return nil
 }
 
-func (ssl *SafeBrowsingList) loadDataFromRedirectLists() error {
+// lookupContains reports whether lookup is present in this list's
+// hash-prefix set, reading from prefixTable when UseMmapPrefixTable
+// built one for this list and falling back to the in-heap Lookup trie
+// otherwise. Callers outside this file (queryUrl, IsListedBatch)
+// should use this instead of reaching into Lookup directly, so they
+// pick up whichever backend this list is actually using.
+func (ssl *SafeBrowsingList) lookupContains(lookup string) bool {
+	if ssl.prefixTable != nil {
+		return ssl.prefixTable.MightContain(lookup)
+	}
+	return ssl.Lookup.Get(lookup)
+}
+
+// bloomSnapshot is the gob-encoded sidecar format a list's bloom
+// filter is persisted in, named EntryCount so load can tell whether
+// the bits it finds on disk still describe the current Lookup trie.
+type bloomSnapshot struct {
+	EntryCount int
+	Bits       []uint64
+}
+
+// bloomFileName is where load persists this list's bloom filter,
+// alongside its Storage-backed "<name>.dat" chunk data.
+func (ssl *SafeBrowsingList) bloomFileName() string {
+	return ssl.FileName + ".bloom"
+}
+
+// loadOrInitBloom returns a bloom filter to use for this load, and
+// whether it still needs populating. If a persisted snapshot exists
+// and was built against exactly prevEntryCount trie entries, its bits
+// are reused unchanged (the common, cheap case on a restart); any
+// other outcome - no file, a corrupt one, or an entry count mismatch -
+// starts a new, empty filter that updateLookupMap must populate as it
+// replays chunks.
+func (ssl *SafeBrowsingList) loadOrInitBloom(prevEntryCount int) (bloom *Bloom, fresh bool) {
+	if ssl.FileName == "" {
+		return newBloom(), true
+	}
+	f, err := os.Open(ssl.bloomFileName())
+	if err != nil {
+		return newBloom(), true
+	}
+	defer f.Close()
+
+	var snapshot bloomSnapshot
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return newBloom(), true
+	}
+	if snapshot.EntryCount != prevEntryCount || len(snapshot.Bits) != BLOOM_FILTER_BITS/64+1 {
+		return newBloom(), true
+	}
+	return &Bloom{Bits: snapshot.Bits}, false
+}
+
+// saveBloomSnapshot persists ssl.bloom so a future loadOrInitBloom can
+// reuse it without rebuilding. A no-op for lists with no backing file
+// (e.g. ones only ever used in tests).
+func (ssl *SafeBrowsingList) saveBloomSnapshot() error {
+	if ssl.FileName == "" || ssl.bloom == nil {
+		return nil
+	}
+	tmpName := ssl.bloomFileName() + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&bloomSnapshot{
+		EntryCount: ssl.EntryCount,
+		Bits:       ssl.bloom.Bits,
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, ssl.bloomFileName())
+}
+
+// defaultMaxParallelRedirects is how many of a list's redirect URLs
+// loadDataFromRedirectLists fetches at once when MaxParallelRedirects
+// is left unset, per Google's documented guidance for the v2.2
+// protocol.
+const defaultMaxParallelRedirects = 4
+
+// loadDataFromRedirectLists fetches every pending redirect in
+// ssl.DataRedirects, up to MaxParallelRedirects at a time, reporting
+// progress through ssl.Progress as each completes, and merges the
+// resulting chunks via load. It aborts, without merging any chunks, as
+// soon as ctx is cancelled.
+func (ssl *SafeBrowsingList) loadDataFromRedirectLists(ctx context.Context) error {
 	if len(ssl.DataRedirects) < 1 {
 		ssl.Logger.Info("No pending updates available")
 		return nil
 	}
 
-	newChunks := make([]*Chunk, 0)
+	total := len(ssl.DataRedirects)
+	start := time.Now()
+	ssl.Progress.OnListStart(ssl.Name, total)
 
-	for _, url := range ssl.DataRedirects {
-		response, err := request(url, "", false)
+	chunksByRedirect := make([][]*Chunk, total)
+	errsByRedirect := make([]error, total)
+
+	maxParallel := ssl.MaxParallelRedirects
+	if maxParallel < 1 {
+		maxParallel = defaultMaxParallelRedirects
+	}
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	for i, url := range ssl.DataRedirects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, url string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			chunks, bytes, err := ssl.fetchRedirectChunks(ctx, url)
+			chunksByRedirect[i] = chunks
+			errsByRedirect[i] = err
+			ssl.Progress.OnRedirectDone(ssl.Name, i, total, bytes)
+		}(i, url)
+	}
+	wg.Wait()
+	ssl.Progress.OnListComplete(ssl.Name, time.Since(start))
+
+	for _, err := range errsByRedirect {
 		if err != nil {
 			return err
 		}
-		if response.StatusCode != 200 {
-			return fmt.Errorf("Unexpected server response code: %d",
-				response.StatusCode)
-		}
+	}
 
-		buf := bufio.NewReader(response.Body)
-		for {
-			chunk, err := ReadChunk(buf)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
+	newChunks := make([]*Chunk, 0)
+	for _, chunks := range chunksByRedirect {
+		newChunks = append(newChunks, chunks...)
+	}
+	return ssl.load(newChunks)
+}
+
+// fetchRedirectChunks downloads and parses a single redirect URL's
+// chunks, returning the number of bytes read so the caller can feed it
+// to ssl.Progress.
+func (ssl *SafeBrowsingList) fetchRedirectChunks(ctx context.Context, url string) ([]*Chunk, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	response, err := ssl.request(ctx, url, "", false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("Unexpected server response code: %d",
+			response.StatusCode)
+	}
+
+	counted := &countingReader{r: response.Body}
+	buf := bufio.NewReader(counted)
+	chunks := make([]*Chunk, 0)
+	for {
+		chunk, err := ReadChunk(buf)
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
-			newChunks = append(newChunks, chunk)
+			return chunks, counted.n, err
 		}
+		chunks = append(chunks, chunk)
 	}
-	return ssl.load(newChunks)
+	return chunks, counted.n, nil
+}
+
+// countingReader wraps an io.Reader to tally the bytes read through
+// it, so loadDataFromRedirectLists can report transfer size to
+// ssl.Progress without buffering the whole response up front.
+type countingReader struct {
+	r io.Reader
+	n int64
 }
 
-func (ssl *SafeBrowsingList) updateLookupMap(chunk *Chunk) {
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// lookupStaging accumulates one load() call's prefix and full-hash add
+// and delete intents in plain maps instead of applying them straight
+// to ssl.Lookup/ssl.FullHashes. load() turns each map into its
+// PrefixSet with a single buildPrefixSet merge pass once every chunk
+// has been replayed, rather than paying a sorted-slice insert for
+// every one of what can be millions of entries.
+type lookupStaging struct {
+	lookup     map[string]bool
+	fullHashes map[string]bool
+}
+
+func newLookupStaging() *lookupStaging {
+	return &lookupStaging{
+		lookup:     make(map[string]bool),
+		fullHashes: make(map[string]bool),
+	}
+}
+
+func stagedKeys(staged map[string]bool) []string {
+	keys := make([]string, 0, len(staged))
+	for key := range staged {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (ssl *SafeBrowsingList) updateLookupMap(chunk *Chunk, staging *lookupStaging) {
 	for hostHashString, hashes := range chunk.Hashes {
 		hostHash := HostHash(hostHashString)
 		for _, hash := range hashes {
@@ -250,9 +570,9 @@ func (ssl *SafeBrowsingList) updateLookupMap(chunk *Chunk) {
 				case CHUNK_TYPE_ADD:
 					ssl.Logger.Debug("Adding full length hash: %s",
 						hex.EncodeToString([]byte(lookupHash)))
-					ssl.FullHashes.Set(lookupHash)
+					staging.fullHashes[lookupHash] = true
 				case CHUNK_TYPE_SUB:
-					ssl.FullHashes.Delete(lookupHash)
+					delete(staging.fullHashes, lookupHash)
 				}
 
 			} else {
@@ -270,14 +590,21 @@ func (ssl *SafeBrowsingList) updateLookupMap(chunk *Chunk) {
 				lookup := string(hostHash) + string(hash)
 				switch chunk.ChunkType {
 				case CHUNK_TYPE_ADD:
-					ssl.Lookup.Set(lookup)
+					staging.lookup[lookup] = true
+					if ssl.bloomFresh {
+						ssl.bloom.Add(lookup)
+					}
 				case CHUNK_TYPE_SUB:
-					ssl.Lookup.Delete(lookup)
-					i := ssl.FullHashes.Iterator()
-					for key := i.Next(); key != ""; key = i.Next() {
+					// bloom has no Delete: a classic Bloom filter can't
+					// unset a bit without risking other keys that
+					// hashed to it, so a removed prefix just lingers
+					// there as a (harmless) possible false positive
+					// until the next full rebuild.
+					delete(staging.lookup, lookup)
+					for key := range staging.fullHashes {
 						keyPrefix := key[0:len(lookup)]
 						if keyPrefix == lookup {
-							ssl.FullHashes.Delete(key)
+							delete(staging.fullHashes, key)
 						}
 					}
 				}
@@ -49,7 +49,7 @@ func TestLoad(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	ssl := newSafeBrowsingList("test", testFilename)
+	ssl := newSafeBrowsingList("test", testFilename, NewLocalStorage(os.TempDir()))
 
 	chunk := &ChunkData{
 		ChunkNumber: proto.Int32(1),
@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package safebrowsingtest provides a fake Safe Browsing v2.2 server for
+// driving SafeBrowsing end-to-end in tests, without a real API key or
+// network access. It implements the three endpoints the client talks
+// to - "list", "downloads" and "gethash" - and lets a test script the
+// "downloads" response with the same magic directives
+// (safebrowsing.processRedirectList) the real server uses: "r" to force
+// a full reset, "e:" to return a server-side error, "n:" to set the
+// next poll delay, and "ad:"/"sd:" to delete previously sent chunks.
+package safebrowsingtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Server is a fake Safe Browsing v2.2 server. The zero value is not
+// usable; create one with NewServer.
+type Server struct {
+	mu sync.Mutex
+
+	srv *httptest.Server
+	mux *http.ServeMux
+
+	// ListNames is returned, one per line, from the "list" endpoint.
+	ListNames []string
+
+	// RedirectScript is the raw body served from the "downloads"
+	// endpoint, in the same directive format the real server and
+	// SafeBrowsing.processRedirectList use, e.g.:
+	//   i:goog-malware-shavar
+	//   u:127.0.0.1:NNNN/chunk/malware-1
+	//   n:1200
+	// Chunks referenced by a "u:" line are served from whatever was
+	// registered with AddChunk.
+	RedirectScript string
+
+	// chunks maps the path component of a chunk redirect URL (as
+	// registered by AddChunk) to its raw wire-format bytes.
+	chunks map[string][]byte
+
+	// GetHashStatus, when non-zero, is returned verbatim as the status
+	// code for every "gethash" request, e.g. http.StatusServiceUnavailable
+	// to drive the client's back-off path.
+	GetHashStatus int
+
+	// GetHashResponse is the raw body served from "gethash" when
+	// GetHashStatus is zero or http.StatusOK.
+	GetHashResponse string
+}
+
+// NewServer starts a fake Safe Browsing server. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{
+		mux:    http.NewServeMux(),
+		chunks: make(map[string][]byte),
+	}
+	s.mux.HandleFunc("/safebrowsing/list", s.handleList)
+	s.mux.HandleFunc("/safebrowsing/downloads", s.handleDownloads)
+	s.mux.HandleFunc("/safebrowsing/gethash", s.handleGetHash)
+	s.mux.HandleFunc("/chunk/", s.handleChunk)
+	s.srv = httptest.NewServer(s.mux)
+	return s
+}
+
+// URL is the base address of the fake server, scheme included
+// (e.g. "http://127.0.0.1:NNNN").
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Close shuts down the underlying httptest.Server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprint(w, strings.Join(s.ListNames, "\n"))
+}
+
+func (s *Server) handleDownloads(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprint(w, s.RedirectScript)
+}
+
+func (s *Server) handleGetHash(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.GetHashStatus != 0 && s.GetHashStatus != http.StatusOK {
+		w.WriteHeader(s.GetHashStatus)
+		return
+	}
+	fmt.Fprint(w, s.GetHashResponse)
+}
+
+func (s *Server) handleChunk(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, ok := s.chunks[r.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// AddChunk registers raw chunk wire-format bytes (see ChunkFixture) to
+// be served at the given path, for use in a "u:" RedirectScript line,
+// e.g. AddChunk("/chunk/malware-1", ChunkFixture(...)).
+func (s *Server) AddChunk(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks[path] = data
+}
+
+// ChunkFixture builds the raw wire-format bytes for a single add/sub
+// chunk, matching what safebrowsing.ReadChunk parses: a
+// "type:num:hashLen:chunkLen\n" header followed by, per host key, a
+// 4-byte host hash, a 1-byte prefix count, and that many hashLen-byte
+// prefixes (a count of 0 means the host hash itself is the only
+// prefix). hostHash must be exactly 4 bytes; every prefix must be
+// exactly hashLen bytes.
+func ChunkFixture(chunkType string, chunkNum int, hashLen int, hostHash string, prefixes []string) []byte {
+	if len(hostHash) != 4 {
+		panic("safebrowsingtest: hostHash must be 4 bytes")
+	}
+	body := make([]byte, 0, 5+len(prefixes)*hashLen)
+	body = append(body, hostHash...)
+	body = append(body, byte(len(prefixes)))
+	for _, prefix := range prefixes {
+		if len(prefix) != hashLen {
+			panic("safebrowsingtest: prefix does not match hashLen")
+		}
+		body = append(body, prefix...)
+	}
+	header := fmt.Sprintf("%s:%d:%d:%d\n", chunkType, chunkNum, hashLen, len(body))
+	return append([]byte(header), body...)
+}
+
+// FullHashResponse builds the raw "gethash" response body for a single
+// matching full hash: the cache lifetime in seconds, followed by one
+// "list:hashLen:numHashes\n<hash>" record, matching what
+// SafeBrowsing.processFullHashes expects (numHashes counts 32-byte
+// hashes, not bytes).
+func FullHashResponse(cacheLifetimeSecs int, list string, fullHash string) string {
+	if len(fullHash) != 32 {
+		panic("safebrowsingtest: fullHash must be 32 bytes")
+	}
+	return fmt.Sprintf("%d\n%s:32:1\n%s", cacheLifetimeSecs, list, fullHash)
+}
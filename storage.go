@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Storage abstracts where a list's on-disk chunk data (the ".dat" file
+// SafeBrowsingList.load reads and rewrites) actually lives. The default
+// is LocalStorage, reading and writing under SafeBrowsing.DataDir as
+// before; an S3-compatible (or GCS, Aliyun OSS, etc.) implementation of
+// this same interface lets multiple instances share one Safe Browsing
+// database in object storage instead of each replica independently
+// downloading the full chunk lists, and lets offline mode work directly
+// out of a remote bucket.
+type Storage interface {
+	// Open returns a reader over the list's current stored data, or an
+	// error satisfying os.IsNotExist if nothing has been stored yet.
+	Open(list string) (io.ReadCloser, error)
+	// Create returns a writer for the list's data. Implementations
+	// should make the write atomic from a reader's perspective (e.g.
+	// write-to-temp-then-rename, as LocalStorage does).
+	Create(list string) (io.WriteCloser, error)
+	// Remove deletes any stored data for the list.
+	Remove(list string) error
+	// Stat returns metadata about the list's stored data.
+	Stat(list string) (Info, error)
+}
+
+// Info describes stored list data without requiring a reader.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// LocalStorage is the default Storage: each list is a file named
+// "<list>.dat" inside a directory on the local filesystem, matching
+// this library's historical behavior.
+type LocalStorage struct {
+	DataDir string
+}
+
+func NewLocalStorage(dataDir string) *LocalStorage {
+	return &LocalStorage{DataDir: dataDir}
+}
+
+func (s *LocalStorage) path(list string) string {
+	return s.DataDir + "/" + list + ".dat"
+}
+
+func (s *LocalStorage) Open(list string) (io.ReadCloser, error) {
+	return os.Open(s.path(list))
+}
+
+// localTempFile wraps the temp file a write is staged into so Close
+// renames it into place atomically, the same way SafeBrowsingList.load
+// always has.
+type localTempFile struct {
+	*os.File
+	finalPath string
+}
+
+func (f *localTempFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.File.Name(), f.finalPath)
+}
+
+func (s *LocalStorage) Create(list string) (io.WriteCloser, error) {
+	finalPath := s.path(list)
+	f, err := os.Create(finalPath + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &localTempFile{File: f, finalPath: finalPath}, nil
+}
+
+func (s *LocalStorage) Remove(list string) error {
+	err := os.Remove(s.path(list))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) Stat(list string) (Info, error) {
+	info, err := os.Stat(s.path(list))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
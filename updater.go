@@ -0,0 +1,350 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// This file implements Updater, a v2.2 update pipeline that refreshes
+// every list concurrently, each on its own schedule, instead of the
+// serial requestRedirectList/processRedirectList round trip ss.update
+// drives for the whole batch at once. It's meant for callers tracking
+// several lists (e.g. googpub-phish-shavar alongside both
+// goog-malware-shavar and goog-unwanted-shavar) who don't want one
+// slow or backed-off list to hold up the others.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxParallelLists bounds how many lists Updater.Run refreshes
+// at once, mirroring defaultMaxParallelRedirects for the redirects
+// within a single list.
+const defaultMaxParallelLists = 4
+
+// updaterListState is one list's own schedule and back-off, tracked
+// independently so a slow or failing list never holds up, or gets
+// pulled forward by, its neighbours.
+type updaterListState struct {
+	nextAttempt    time.Time
+	backoffAttempt int
+	// needsRekey is set once this list's server has responded with
+	// "e:pleaserekey"; Updater has no MAC key-exchange of its own, so
+	// it can't act on this beyond backing off and logging - a future
+	// key-exchange implementation would clear it once a fresh key is
+	// negotiated.
+	needsRekey bool
+}
+
+// Updater refreshes every list of a SafeBrowsing across a bounded pool
+// of worker goroutines. Each list's chunks are still downloaded and
+// parsed through fetchRedirectChunks/ReadChunkStream and committed via
+// SafeBrowsingList.load exactly as the serial path does, so the only
+// thing Updater changes is the scheduling: lists are fetched
+// concurrently, each against its own next-attempt time and back-off
+// state, and a list whose redirect response fails checksum
+// verification is dropped before any of its chunks are applied,
+// leaving the previous snapshot (and the previous Lookup/FullHashes
+// pointers SafeBrowsingList.load swaps in atomically) untouched.
+type Updater struct {
+	ss *SafeBrowsing
+	// MaxParallelLists bounds how many lists are refreshed at once;
+	// defaults to defaultMaxParallelLists.
+	MaxParallelLists int
+
+	mu    sync.Mutex
+	state map[string]*updaterListState
+}
+
+// NewUpdater returns an Updater over ss's current lists and request
+// plumbing. Call Run to drive one scheduling pass; the caller is
+// responsible for calling it again (e.g. on a timer) for subsequent
+// passes, the same way SafeBrowsing.reloadLoop drives ss.update.
+func NewUpdater(ss *SafeBrowsing) *Updater {
+	return &Updater{
+		ss:               ss,
+		MaxParallelLists: defaultMaxParallelLists,
+		state:            make(map[string]*updaterListState),
+	}
+}
+
+// stateFor returns name's schedule, creating a fresh (immediately due)
+// one the first time a list is seen.
+func (u *Updater) stateFor(name string) *updaterListState {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s, exists := u.state[name]
+	if !exists {
+		s = &updaterListState{}
+		u.state[name] = s
+	}
+	return s
+}
+
+// Run fetches updates for every list whose next-attempt time has
+// passed, across up to MaxParallelLists worker goroutines, and returns
+// once they have all either committed or backed off. Lists that
+// aren't due yet are left alone; it's the caller's job to call Run
+// again later. It returns the first error encountered, if any, but
+// every due list is still attempted regardless of whether an earlier
+// one failed.
+func (u *Updater) Run(ctx context.Context) error {
+	maxParallel := u.MaxParallelLists
+	if maxParallel < 1 {
+		maxParallel = defaultMaxParallelLists
+	}
+
+	type job struct {
+		name string
+		ssl  *SafeBrowsingList
+	}
+	now := time.Now()
+	jobs := make([]job, 0, len(u.ss.Lists))
+	for name, ssl := range u.ss.Lists {
+		if u.stateFor(name).nextAttempt.After(now) {
+			continue
+		}
+		jobs = append(jobs, job{name: name, ssl: ssl})
+	}
+
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	errs := make([]error, len(jobs))
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, j job) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = u.updateList(ctx, j.name, j.ssl)
+		}(i, j)
+	}
+	wg.Wait()
+
+	var firstErr error
+	for _, err := range errs {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// updateList refreshes a single list: it requests that list's own
+// redirects, verifies the response's checksum (if any) before trusting
+// it, and on success hands the redirects off to
+// SafeBrowsingList.loadDataFromRedirectLists, which does the actual
+// streaming download, parse and commit. Any failure - a network error,
+// a failed checksum, or the server asking to rekey - backs this list
+// off via ss.BackoffPolicy without touching its existing data.
+func (u *Updater) updateList(ctx context.Context, name string, ssl *SafeBrowsingList) error {
+	state := u.stateFor(name)
+
+	result, err := u.requestListUpdate(ctx, name, ssl)
+	if err == nil && result.rekey {
+		err = fmt.Errorf("server requested a rekey for %s", name)
+		state.needsRekey = true
+	}
+	if err == nil && result.svrError != "" {
+		err = fmt.Errorf("error received from server for %s: %s", name, result.svrError)
+	}
+	if err != nil {
+		u.backOff(state)
+		u.ss.Logger.Warn("Update failed for %s, backing off until %s: %s",
+			name, state.nextAttempt.Format(time.RFC3339), err)
+		return err
+	}
+
+	if result.reset {
+		if rmErr := u.ss.Storage.Remove(ssl.Name); rmErr != nil {
+			u.ss.Logger.Warn("Error removing stored data for %s: %s", ssl.Name, rmErr)
+		}
+		ssl.ChunkRanges = map[ChunkType]string{CHUNK_TYPE_ADD: "", CHUNK_TYPE_SUB: ""}
+	}
+
+	ssl.DataRedirects = result.redirects
+	ssl.DeleteChunks = result.deleteChunks
+	if err := ssl.loadDataFromRedirectLists(ctx); err != nil {
+		u.backOff(state)
+		u.ss.Logger.Warn("Update failed for %s, backing off until %s: %s",
+			name, state.nextAttempt.Format(time.RFC3339), err)
+		return err
+	}
+
+	state.needsRekey = false
+	state.backoffAttempt = 0
+	nextPoll := result.nextPoll
+	if nextPoll <= 0 {
+		nextPoll = time.Duration(u.ss.UpdateDelay) * time.Second
+	}
+	state.nextAttempt = time.Now().Add(nextPoll)
+	return nil
+}
+
+// backOff advances state to the next back-off delay from
+// ss.BackoffPolicy, so a list that keeps failing is retried less and
+// less often instead of hammering the server every Run.
+func (u *Updater) backOff(state *updaterListState) {
+	policy := u.ss.BackoffPolicy
+	if policy == nil {
+		policy = NewDefaultBackoffPolicy()
+	}
+	state.nextAttempt = time.Now().Add(policy.NextDelay(state.backoffAttempt))
+	state.backoffAttempt++
+}
+
+// listUpdateResult is what parseListUpdateResponse extracts from a
+// single list's downloads response.
+type listUpdateResult struct {
+	reset        bool
+	rekey        bool
+	svrError     string
+	redirects    []string
+	deleteChunks map[ChunkType]map[ChunkNum]bool
+	nextPoll     time.Duration
+	checksum     string
+}
+
+// requestListUpdate issues a single-list downloads request for name,
+// carrying its current chunk ranges the same way requestRedirectList
+// does for the whole batch, then verifies and parses the response.
+func (u *Updater) requestListUpdate(ctx context.Context, name string, ssl *SafeBrowsingList) (*listUpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ss := u.ss
+
+	url := fmt.Sprintf(
+		"https://safebrowsing.clients.google.com/safebrowsing/downloads?"+
+			"client=%s&apikey=%s&appver=%s&pver=2.2",
+		ss.Client, ss.Key, ss.AppVersion)
+
+	body := name + ";"
+	if addRange := ssl.ChunkRanges[CHUNK_TYPE_ADD]; addRange != "" {
+		body += "a:" + addRange + ":"
+	}
+	if subRange := ssl.ChunkRanges[CHUNK_TYPE_SUB]; subRange != "" {
+		body += "s:" + subRange
+	}
+	body += "\n"
+
+	response, err := ss.request(ctx, url, body, true)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected server response code: %d", response.StatusCode)
+	}
+
+	raw := &bytes.Buffer{}
+	if _, err := raw.ReadFrom(response.Body); err != nil {
+		return nil, fmt.Errorf("unable to read list update response: %s", err)
+	}
+	return parseListUpdateResponse(raw.Bytes())
+}
+
+// parseListUpdateResponse parses a single list's downloads response
+// and verifies its "m:" checksum line, if present, before returning
+// anything the caller might apply. The checksum covers every byte of
+// the response preceding the "m:" line itself, so a truncated or
+// tampered redirect/delete-chunk set is caught before its chunks are
+// ever fetched, let alone committed.
+func parseListUpdateResponse(body []byte) (*listUpdateResult, error) {
+	result := &listUpdateResult{
+		redirects: make([]string, 0),
+		deleteChunks: map[ChunkType]map[ChunkNum]bool{
+			CHUNK_TYPE_ADD: make(map[ChunkNum]bool),
+			CHUNK_TYPE_SUB: make(map[ChunkNum]bool),
+		},
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	consumed := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineEnd := consumed + len(line)
+		bits := strings.SplitN(line, ":", 2)
+		if len(bits) != 2 {
+			consumed = lineEnd + 1
+			continue
+		}
+		switch bits[0] {
+		case "r":
+			result.reset = true
+		case "u":
+			result.redirects = append(result.redirects, "https://"+bits[1])
+		case "n":
+			secs, err := strconv.Atoi(bits[1])
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse timeout: %s", err)
+			}
+			result.nextPoll = time.Duration(secs) * time.Second
+		case "e":
+			if bits[1] == "pleaserekey" {
+				result.rekey = true
+			} else {
+				result.svrError = bits[1]
+			}
+		case "ad":
+			deletes, err := parseChunkRange(bits[1])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing delete add chunks range: %s", err)
+			}
+			result.deleteChunks[CHUNK_TYPE_ADD] = deletes
+		case "sd":
+			deletes, err := parseChunkRange(bits[1])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing delete sub chunks range: %s", err)
+			}
+			result.deleteChunks[CHUNK_TYPE_SUB] = deletes
+		case "m":
+			result.checksum = bits[1]
+			if !checksumMatches(body[:consumed], result.checksum) {
+				return nil, fmt.Errorf("checksum mismatch in list update response, dropping update")
+			}
+		}
+		consumed = lineEnd + 1
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to parse list update response: %s", err)
+	}
+	return result, nil
+}
+
+// checksumMatches reports whether want (base64-encoded) equals the
+// sha256 of prefix, the same digest-then-base64 shape
+// checksumMatchesV4 already checks server-sent checksums against.
+func checksumMatches(prefix []byte, want string) bool {
+	h := sha256.New()
+	h.Write(prefix)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)) == want
+}
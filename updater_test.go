@@ -0,0 +1,86 @@
+package safebrowsing
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestParseListUpdateResponse(t *testing.T) {
+	body := "u:example.com/redirect1\n" +
+		"u:example.com/redirect2\n" +
+		"ad:1-3\n" +
+		"sd:4\n" +
+		"n:1200\n"
+
+	result, err := parseListUpdateResponse([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(result.redirects) != 2 {
+		t.Fatalf("expected 2 redirects, got %d", len(result.redirects))
+	}
+	if result.redirects[0] != "https://example.com/redirect1" {
+		t.Fatalf("unexpected redirect: %s", result.redirects[0])
+	}
+	if result.nextPoll.Seconds() != 1200 {
+		t.Fatalf("expected a 1200s next poll, got %s", result.nextPoll)
+	}
+	for _, num := range []ChunkNum{1, 2, 3} {
+		if !result.deleteChunks[CHUNK_TYPE_ADD][num] {
+			t.Fatalf("expected add chunk %d to be marked for delete", num)
+		}
+	}
+	if !result.deleteChunks[CHUNK_TYPE_SUB][4] {
+		t.Fatal("expected sub chunk 4 to be marked for delete")
+	}
+}
+
+func TestParseListUpdateResponsePleaseRekey(t *testing.T) {
+	result, err := parseListUpdateResponse([]byte("e:pleaserekey\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !result.rekey {
+		t.Fatal("expected rekey to be true")
+	}
+}
+
+func TestParseListUpdateResponseChecksumOK(t *testing.T) {
+	prefix := "u:example.com/redirect1\nn:1200\n"
+	h := sha256.Sum256([]byte(prefix))
+	checksum := base64.StdEncoding.EncodeToString(h[:])
+
+	result, err := parseListUpdateResponse([]byte(prefix + "m:" + checksum + "\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.checksum != checksum {
+		t.Fatalf("expected checksum to be recorded, got %s", result.checksum)
+	}
+}
+
+func TestParseListUpdateResponseChecksumMismatch(t *testing.T) {
+	body := "u:example.com/redirect1\nn:1200\nm:not-the-right-checksum\n"
+	if _, err := parseListUpdateResponse([]byte(body)); err == nil {
+		t.Fatal("expected a checksum mismatch error")
+	}
+}
+
+func TestUpdaterBackOff(t *testing.T) {
+	ss := &SafeBrowsing{BackoffPolicy: NewDefaultBackoffPolicy()}
+	u := NewUpdater(ss)
+	state := u.stateFor("goog-malware-shavar")
+	if state.nextAttempt.After(time.Now()) {
+		t.Fatal("expected a freshly seen list to be immediately due")
+	}
+
+	u.backOff(state)
+	if !state.nextAttempt.After(time.Now()) {
+		t.Fatal("expected backOff to push nextAttempt into the future")
+	}
+	if state.backoffAttempt != 1 {
+		t.Fatalf("expected backoffAttempt to advance to 1, got %d", state.backoffAttempt)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright (c) 2013, Richard Johnson
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// This file implements the v4 Update API (threatListUpdates:fetch),
+// used instead of the legacy pver=2.2 "list"/"downloads" pair when
+// ProtocolVersion == ProtocolV4. It keeps each list's server-issued
+// state token and applies RAW- or RICE-encoded (see v4rice.go)
+// ADDITION/REMOVAL diffs against the same Lookup/FullHashes tries the
+// v3 code path populates, so IsListed/MightBeListed/IsUpToDate work
+// unchanged regardless of which protocol fetched the data.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const v4ThreatListUpdatesURL = "https://safebrowsing.googleapis.com/v4/threatListUpdates:fetch"
+
+// constraintsV4 limits what the server may send back; we advertise
+// both RAW and RICE (Golomb-Rice delta encoded) so the server can pick
+// whichever is smaller, since both are decoded by
+// applyThreatListUpdateV4.
+type constraintsV4 struct {
+	SupportedCompressions []string `json:"supportedCompressions,omitempty"`
+}
+
+type listUpdateRequestV4 struct {
+	ThreatType      string        `json:"threatType"`
+	PlatformType    string        `json:"platformType"`
+	ThreatEntryType string        `json:"threatEntryType"`
+	State           string        `json:"state,omitempty"`
+	Constraints     constraintsV4 `json:"constraints"`
+}
+
+type fetchThreatListUpdatesRequestV4 struct {
+	Client             clientInfoV4           `json:"client"`
+	ListUpdateRequests []listUpdateRequestV4  `json:"listUpdateRequests"`
+}
+
+type rawHashesV4 struct {
+	PrefixSize int    `json:"prefixSize"`
+	RawHashes  string `json:"rawHashes"`
+}
+
+type rawIndicesV4 struct {
+	Indices []int32 `json:"indices"`
+}
+
+// threatEntrySetV4 is either an ADDITION or a REMOVAL, RAW- or
+// RICE-compressed per CompressionType; applyThreatListUpdateV4 decodes
+// whichever of the four fields is populated accordingly.
+type threatEntrySetV4 struct {
+	CompressionType string               `json:"compressionType"`
+	RawHashes       *rawHashesV4         `json:"rawHashes,omitempty"`
+	RawIndices      *rawIndicesV4        `json:"rawIndices,omitempty"`
+	RiceHashes      *riceDeltaEncodingV4 `json:"riceHashes,omitempty"`
+	RiceIndices     *riceDeltaEncodingV4 `json:"riceIndices,omitempty"`
+}
+
+type checksumV4 struct {
+	Sha256 string `json:"sha256"`
+}
+
+type listUpdateResponseV4 struct {
+	ThreatType      string             `json:"threatType"`
+	PlatformType    string             `json:"platformType"`
+	ThreatEntryType string             `json:"threatEntryType"`
+	ResponseType    string             `json:"responseType"`
+	Additions       []threatEntrySetV4 `json:"additions"`
+	Removals        []threatEntrySetV4 `json:"removals"`
+	NewClientState  string             `json:"newClientState"`
+	Checksum        checksumV4         `json:"checksum"`
+}
+
+type fetchThreatListUpdatesResponseV4 struct {
+	ListUpdateResponses []listUpdateResponseV4 `json:"listUpdateResponses"`
+	MinimumWaitDuration string                 `json:"minimumWaitDuration"`
+}
+
+// updateV4 is the v4 equivalent of update(): it fetches diffs for
+// every list in ss.ThreatLists and reschedules reloadLoop according to
+// the server's minimumWaitDuration. ctx bounds the underlying HTTP
+// call, the same as it does for the v3 path.
+func (ss *SafeBrowsing) updateV4(ctx context.Context) error {
+	ss.Logger.Info("Requesting threat list updates from server...")
+	wait, err := ss.requestThreatListUpdatesV4(ctx)
+	if err != nil {
+		return err
+	}
+
+	ss.LastUpdated = time.Now()
+	for listName := range ss.Lists {
+		ss.Metrics.SetListLastUpdateTimestamp(listName, ss.LastUpdated)
+	}
+
+	switch {
+	case wait > 0:
+		ss.UpdateDelay = int(wait.Seconds())
+	case ss.UpdateDelay == 0:
+		// the v4 docs recommend polling no more than once every 30
+		// minutes when the server doesn't say otherwise.
+		ss.UpdateDelay = 1800
+	}
+	return nil
+}
+
+// requestThreatListUpdatesV4 POSTs a listUpdateRequest per configured
+// ThreatList, carrying forward whatever state token we have for it,
+// and applies the diffs in the response.
+func (ss *SafeBrowsing) requestThreatListUpdatesV4(ctx context.Context) (time.Duration, error) {
+	listUpdateRequests := make([]listUpdateRequestV4, 0, len(ss.ThreatLists))
+	for _, descriptor := range ss.ThreatLists {
+		name := descriptor.Name()
+		ssl, exists := ss.Lists[name]
+		if !exists {
+			fileName := ss.DataDir + "/" + name + ".dat"
+			ssl = newSafeBrowsingList(name, fileName, ss.Storage)
+			ssl.Logger = ss.Logger
+			ssl.Metrics = ss.Metrics
+			ssl.Progress = ss.Progress
+			ssl.request = ss.request
+			ssl.MaxParallelRedirects = ss.MaxParallelRedirects
+			ssl.Descriptor = descriptor
+			ss.Lists[name] = ssl
+		}
+		listUpdateRequests = append(listUpdateRequests, listUpdateRequestV4{
+			ThreatType:      descriptor.ThreatType,
+			PlatformType:    descriptor.PlatformType,
+			ThreatEntryType: descriptor.ThreatEntryType,
+			State:           ssl.State,
+			Constraints: constraintsV4{
+				SupportedCompressions: []string{"RAW", "RICE"},
+			},
+		})
+	}
+
+	reqBody := fetchThreatListUpdatesRequestV4{
+		Client: clientInfoV4{
+			ClientId:      ss.Client,
+			ClientVersion: ss.AppVersion,
+		},
+		ListUpdateRequests: listUpdateRequests,
+	}
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return 0, err
+	}
+
+	url := fmt.Sprintf("%s?key=%s", v4ThreatListUpdatesURL, ss.Key)
+	response, err := ss.request(ctx, url, string(body), true)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return 0, fmt.Errorf("Unexpected server response code: %d", response.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp fetchThreatListUpdatesResponseV4
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	for _, lur := range resp.ListUpdateResponses {
+		descriptor := ListDescriptor{
+			ThreatType:      lur.ThreatType,
+			PlatformType:    lur.PlatformType,
+			ThreatEntryType: lur.ThreatEntryType,
+		}
+		ssl, exists := ss.Lists[descriptor.Name()]
+		if !exists {
+			continue
+		}
+		if err := ssl.applyThreatListUpdateV4(lur); err != nil {
+			return 0, fmt.Errorf("Unable to process v4 update for %s: %s", ssl.Name, err)
+		}
+	}
+
+	return parseV4Duration(resp.MinimumWaitDuration), nil
+}
+
+// applyThreatListUpdateV4 applies one list's diff: a FULL_UPDATE clears
+// the local tries first, then removals (resolved against the
+// lexicographically-sorted database as it stood before this response,
+// per the v4 spec) are applied before additions, and finally the
+// checksum is verified, falling back to a forced full refresh on
+// mismatch.
+func (ssl *SafeBrowsingList) applyThreatListUpdateV4(resp listUpdateResponseV4) error {
+	ssl.updateLock.Lock()
+	defer ssl.updateLock.Unlock()
+
+	if resp.ResponseType == "FULL_UPDATE" {
+		ssl.Lookup = NewPrefixSet()
+		ssl.FullHashes = NewPrefixSet()
+	}
+
+	sorted := sortedTrieKeys(ssl.Lookup)
+	for _, set := range resp.Removals {
+		var indices []int32
+		switch set.CompressionType {
+		case "", "RAW":
+			if set.RawIndices == nil {
+				continue
+			}
+			indices = set.RawIndices.Indices
+		case "RICE":
+			if set.RiceIndices == nil {
+				continue
+			}
+			decoded, err := decodeRiceIndicesV4(set.RiceIndices)
+			if err != nil {
+				return err
+			}
+			indices = decoded
+		default:
+			return fmt.Errorf("%s-encoded removals not supported", set.CompressionType)
+		}
+		for _, index := range indices {
+			if index < 0 || int(index) >= len(sorted) {
+				continue
+			}
+			ssl.Lookup.Delete(sorted[index])
+		}
+	}
+
+	for _, set := range resp.Additions {
+		var prefixes []string
+		var err error
+		switch set.CompressionType {
+		case "", "RAW":
+			if set.RawHashes == nil {
+				continue
+			}
+			prefixes, err = decodeRawHashesV4(set.RawHashes)
+		case "RICE":
+			if set.RiceHashes == nil {
+				continue
+			}
+			prefixes, err = decodeRiceHashesV4(set.RiceHashes)
+		default:
+			return fmt.Errorf("%s-encoded additions not supported", set.CompressionType)
+		}
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			if len(prefix) == 32 {
+				ssl.FullHashes.Set(prefix)
+			} else {
+				ssl.Lookup.Set(prefix)
+			}
+		}
+	}
+
+	ssl.State = resp.NewClientState
+
+	if resp.Checksum.Sha256 != "" && !ssl.checksumMatchesV4(resp.Checksum.Sha256) {
+		ssl.Logger.Warn(
+			"Checksum mismatch applying v4 update for %s, forcing full refresh next cycle",
+			ssl.Name)
+		ssl.State = ""
+		ssl.Lookup = NewPrefixSet()
+		ssl.FullHashes = NewPrefixSet()
+	}
+
+	return nil
+}
+
+// decodeRawHashesV4 splits a base64-encoded, concatenated run of
+// fixed-width hash prefixes back into the individual prefixes.
+func decodeRawHashesV4(rh *rawHashesV4) ([]string, error) {
+	data, err := base64.StdEncoding.DecodeString(rh.RawHashes)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed rawHashes in v4 update: %s", err)
+	}
+	if rh.PrefixSize <= 0 || len(data)%rh.PrefixSize != 0 {
+		return nil, fmt.Errorf("rawHashes length %d not a multiple of prefixSize %d", len(data), rh.PrefixSize)
+	}
+	prefixes := make([]string, 0, len(data)/rh.PrefixSize)
+	for i := 0; i < len(data); i += rh.PrefixSize {
+		prefixes = append(prefixes, string(data[i:i+rh.PrefixSize]))
+	}
+	return prefixes, nil
+}
+
+// sortedTrieKeys returns every key in the set, which PrefixSet.Iterator
+// already yields in sorted order.
+func sortedTrieKeys(t *PrefixSet) []string {
+	keys := make([]string, 0)
+	it := t.Iterator()
+	for key := it.Next(); key != ""; key = it.Next() {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// checksumMatchesV4 verifies the server's sha256 checksum, computed
+// over the sorted, concatenated hash prefixes, the same way the v4
+// spec requires clients to validate their local database after
+// applying a diff.
+func (ssl *SafeBrowsingList) checksumMatchesV4(want string) bool {
+	h := sha256.New()
+	for _, key := range sortedTrieKeys(ssl.Lookup) {
+		h.Write([]byte(key))
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)) == want
+}
@@ -32,6 +32,8 @@ import (
 	"net/http"
 	"os"
 	"encoding/json"
+	"sync/atomic"
+	"time"
 )
 
 type Config struct {
@@ -83,25 +85,16 @@ type UrlResponse struct {
 	FullHashesRequested bool `json:"fullHashesRequested,omitempty"`
 }
 
-var warnings map[string]map[string]string = map[string]map[string]string{
-	"goog-malware-shavar": map[string]string{
-		"title": "Warning - Visiting this web site may harm your computer.",
-		"text": "This page may be a forgery or imitation of another website, " +
-				"designed to trick users into sharing personal or financial " +
-				"information. Entering any personal information on this page " +
-				"may result in identity theft or other abuse. You can find " +
-				"out more about phishing from http://www.antiphishing.org/",
-	},
-	"googpub-phish-shavar": map[string]string{
-		"title": "Warning - Suspected phishing page.",
-		"text": "This page appears to contain malicious code that could be " +
-				"downloaded to your computer without your consent. You can " +
-				"learn more about harmful web content including viruses and " +
-				"other malicious code and how to protect your computer at " +
-				"http://StopBadware.org/",
-	},
+// BatchResponse is the shape returned by the "/" handler: one
+// UrlResponse per requested URL, plus some request-level metadata.
+type BatchResponse struct {
+	Results   map[string]*UrlResponse `json:"results"`
+	RequestId int64                   `json:"requestId"`
+	ElapsedMs int64                   `json:"elapsedMs"`
 }
 
+var requestCounter int64
+
 func handleHtml(w http.ResponseWriter, r *http.Request) {
 	html := `<!DOCTYPE html>
 	<html>
@@ -130,30 +123,30 @@ func handleHtml(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func queryUrl(url string) (response *UrlResponse) {
-	response = new(UrlResponse)
-	list, err := ss.IsListed(url)
-	if err != nil {
-		fmt.Sprintf(response.Error, "Error looking up url: %s", err.Error())
+func resultToResponse(result safebrowsing.Result) *UrlResponse {
+	response := new(UrlResponse)
+	if result.Err != nil {
+		response.Error = result.Err.Error()
 	}
-	println(list)
-	if list != "" {
+	if result.List != "" {
 		response.IsListed = true
-		response.List = list
-		response.WarningTitle = warnings[list]["title"]
-		response.WarningText = warnings[list]["text"]
+		response.List = result.List
+		response.WarningTitle = result.Descriptor.Title()
+		response.WarningText = result.Descriptor.Description()
 	}
 	return response
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	requestId := atomic.AddInt64(&requestCounter, 1)
+
 	err := r.ParseForm()
 	if err != nil {
 		fmt.Fprintf(w, "Error loading form: %s", err.Error())
 		return
 	}
 
-	println(r.FormValue("urls"))
 	urls := make([]string, 0)
 	err = json.Unmarshal([]byte(r.FormValue("urls")), &urls)
 	if err != nil {
@@ -161,11 +154,23 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	output := make(map[string]*UrlResponse, 0)
-	for _, url := range urls {
-		output[url] = queryUrl(url)
+	results, err := ss.IsListedBatch(urls)
+	if err != nil {
+		fmt.Fprintf(w, "Error checking urls: %s", err.Error())
+		return
+	}
+
+	output := make(map[string]*UrlResponse, len(results))
+	for _, result := range results {
+		output[result.URL] = resultToResponse(result)
+	}
+
+	batchResponse := &BatchResponse{
+		Results:   output,
+		RequestId: requestId,
+		ElapsedMs: time.Since(start).Milliseconds(),
 	}
-	txtOutput, err := json.Marshal(output)
+	txtOutput, err := json.Marshal(batchResponse)
 	if err != nil {
 		fmt.Fprintf(w, "Error marshalling response: %s", err.Error())
 		return